@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Error codes reported to clients in error messages
+const (
+	errorInvalidJSON    = "invalid_json"    // The message is not valid JSON or has fields of the wrong type
+	errorUnknownType    = "unknown_type"    // The message type is neither built in nor registered
+	errorInvalidMessage = "invalid_message" // The message is missing fields or does not match its schema
+	errorTooLong        = "too_long"        // Text, metadata or payload exceed their limit
+	errorInvalidChars   = "invalid_chars"   // Text contains control characters
+	errorForbidden      = "forbidden"       // The connection may not send the message
+	errorNotFound       = "not_found"       // The message to edit, delete or react to does not exist
+	errorRateLimited    = "rate_limited"    // The sender exceeded a rate limit
+	errorMuted          = "muted"           // A moderator muted the sender
+	errorFiltered       = "filtered"        // A content filter rejected the text
+	errorRejected       = "rejected"        // A moderator rejected the held message
+	errorInternal       = "internal_error"  // The server failed to process the message
+)
+
+const maxClientMsgIDLength = 128
+
+// AckData confirms that a message sent with a clientMsgId was accepted
+type AckData struct {
+	ClientMsgID string `json:"clientMsgId"`
+	ID          string `json:"id,omitempty"`   // ID of the stored message, if any
+	Seq         uint64 `json:"seq,omitempty"`  // Sequence number of the stored message, if any
+	Held        bool   `json:"held,omitempty"` // The message waits for review and is not delivered yet
+}
+
+// ErrorData reports why a client message was rejected
+type ErrorData struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+}
+
+// clientError is a validation error with the code reported to the client
+type clientError struct {
+	code    string
+	message string
+}
+
+func (e *clientError) Error() string {
+	return e.message
+}
+
+var (
+	errInvalidChars   = &clientError{errorInvalidChars, "invalid characters in message"}
+	errMessageTooLong = &clientError{errorTooLong, "message too long"}
+	errUnknownType    = &clientError{errorUnknownType, "invalid message type"}
+)
+
+// newClientError returns a validation error with the given code
+func newClientError(code, format string, args ...interface{}) error {
+	return &clientError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// errorCode returns the code reported to the client for a validation error
+func errorCode(err error) string {
+	var ce *clientError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return errorInvalidMessage
+}
+
+// acknowledge confirms a message the hub does not route, such as a typing
+// state. Replies go through the hub so they are never sent to a closed client
+func (c *Client) acknowledge(clientMsgID string) {
+	if clientMsgID == "" {
+		return
+	}
+	c.hub.broadcast <- WebSocketMessage{
+		Type:      "ack",
+		Room:      c.currentRoom(),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      AckData{ClientMsgID: clientMsgID},
+		origin:    c,
+	}
+}
+
+// reject reports a rejected message back to the client
+func (c *Client) reject(clientMsgID, code, message string) {
+	c.hub.broadcast <- WebSocketMessage{
+		Type:      "error",
+		Room:      c.currentRoom(),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      ErrorData{Code: code, Message: message, ClientMsgID: clientMsgID},
+		origin:    c,
+	}
+}
+
+// acknowledge confirms a routed message to its sender when it has a clientMsgId
+func (h *Hub) acknowledge(msg WebSocketMessage) {
+	if msg.origin == nil || msg.clientMsgID == "" {
+		return
+	}
+	h.reply(msg.origin, WebSocketMessage{
+		Type:      "ack",
+		Room:      msg.Room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      AckData{ClientMsgID: msg.clientMsgID, ID: msg.ID, Seq: msg.Seq},
+	})
+}
+
+// rejectMessage reports a message the hub could not apply to its sender
+func (h *Hub) rejectMessage(msg WebSocketMessage, code, message string) {
+	if msg.origin == nil {
+		return
+	}
+	h.reply(msg.origin, WebSocketMessage{
+		Type:      "error",
+		Room:      msg.Room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      ErrorData{Code: code, Message: message, ClientMsgID: msg.clientMsgID},
+	})
+}
+
+// reply sends a message to a single client if it is still connected
+func (h *Hub) reply(client *Client, msg WebSocketMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal %s: %v", msg.Type, err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	client.trySend(data, msg.Type)
+}
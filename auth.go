@@ -0,0 +1,485 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token scopes
+const (
+	scopeRead        = "read"         // List rooms, read history, connect to /ws
+	scopeWrite       = "write"        // Send messages over /ws
+	scopeDM          = "dm"           // Send direct messages to users in other rooms
+	scopeModerate    = "moderate"     // Edit and delete messages of other users, kick, mute and ban
+	scopeRoomAdmin   = "room-admin"   // Create, update and delete rooms
+	scopeServerAdmin = "server-admin" // Everything, including token management
+)
+
+var validScopes = map[string]bool{
+	scopeRead:        true,
+	scopeWrite:       true,
+	scopeDM:          true,
+	scopeModerate:    true,
+	scopeRoomAdmin:   true,
+	scopeServerAdmin: true,
+}
+
+var (
+	errNoCredentials      = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errTokenNotFound      = errors.New("token not found")
+)
+
+// Principal is the authenticated identity behind a request or connection
+type Principal struct {
+	Subject string // Token name or JWT subject, "anonymous" when authentication is disabled
+	TokenID string // ID of the API token used, if any
+	Scopes  []string
+	Name    string   // Chat name bound by a JWT, empty when the client chooses its name
+	Rooms   []string // Rooms a JWT allows joining, empty allows all
+	Roles   []string
+}
+
+// CanJoin reports whether the principal may join room
+func (p *Principal) CanJoin(room string) bool {
+	if len(p.Rooms) == 0 {
+		return true
+	}
+	for _, allowed := range p.Rooms {
+		if allowed == room || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the principal is granted scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == scopeServerAdmin {
+			return true
+		}
+	}
+	// Any scope grants read access
+	return scope == scopeRead && len(p.Scopes) > 0
+}
+
+// IsModerator reports whether the principal may act on messages of other
+// users. Anonymous principals never may, even though they hold every scope
+func (p *Principal) IsModerator() bool {
+	return p != anonymousPrincipal && p.HasScope(scopeModerate)
+}
+
+// sameIdentity reports whether two principals are the same authenticated
+// identity. Anonymous principals never are
+func (p *Principal) sameIdentity(other *Principal) bool {
+	if p == anonymousPrincipal || other == anonymousPrincipal {
+		return false
+	}
+	if p.TokenID != "" || other.TokenID != "" {
+		return p.TokenID == other.TokenID
+	}
+	return p.Subject == other.Subject
+}
+
+// anonymousPrincipal is used for every request when authentication is disabled
+var anonymousPrincipal = &Principal{
+	Subject: "anonymous",
+	Scopes:  []string{scopeServerAdmin},
+}
+
+// APIToken describes an issued bearer token. The secret itself is never stored.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Roles     []string   `json:"roles,omitempty"` // Roles used to select rate limit overrides
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Hash      string     `json:"hash,omitempty"` // SHA-256 of the secret, only written to the token file
+}
+
+// expired reports whether the token is past its expiry time
+func (t *APIToken) expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// TokenStore keeps issued API tokens, optionally persisted to a JSON file
+type TokenStore struct {
+	mu     sync.RWMutex
+	path   string
+	tokens map[string]*APIToken // Keyed by secret hash
+}
+
+// NewTokenStore creates a token store, loading tokens from path if it is set
+func NewTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{path: path, tokens: make(map[string]*APIToken)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	var tokens []*APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %w", err)
+	}
+	for _, token := range tokens {
+		s.tokens[token.Hash] = token
+	}
+	log.Printf("[INFO] Loaded %d API tokens from %s", len(tokens), path)
+	return s, nil
+}
+
+// hashToken returns the hex encoded SHA-256 of a token secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a new token and returns its secret
+func (s *TokenStore) Issue(name string, scopes, roles []string, ttl time.Duration) (string, APIToken, error) {
+	secret := generateID("bst")
+	token := &APIToken{
+		ID:        generateID("tok"),
+		Name:      name,
+		Scopes:    scopes,
+		Roles:     roles,
+		CreatedAt: time.Now().UTC(),
+		Hash:      hashToken(secret),
+	}
+	if ttl > 0 {
+		expiresAt := token.CreatedAt.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[token.Hash] = token
+	if err := s.save(); err != nil {
+		delete(s.tokens, token.Hash)
+		return "", APIToken{}, err
+	}
+	return secret, *token, nil
+}
+
+// Revoke deletes the token with the given ID
+func (s *TokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.tokens {
+		if token.ID == id {
+			delete(s.tokens, hash)
+			return s.save()
+		}
+	}
+	return fmt.Errorf("%w: %s", errTokenNotFound, id)
+}
+
+// List returns every issued token, oldest first
+func (s *TokenStore) List() []APIToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := make([]APIToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, *token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// Lookup returns the valid token matching a secret
+func (s *TokenStore) Lookup(secret string) (APIToken, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.tokens[hashToken(secret)]
+	if !ok || token.expired() {
+		return APIToken{}, false
+	}
+	return *token, true
+}
+
+// save writes the tokens to the token file, caller must hold the lock
+func (s *TokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	tokens := make([]*APIToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	if err := writeFileAtomic(s.path, tokens); err != nil {
+		return fmt.Errorf("failed to write token file: %w", err)
+	}
+	return nil
+}
+
+// Authenticator resolves the principal of HTTP and WebSocket requests
+type Authenticator struct {
+	tokens     *TokenStore
+	required   bool
+	adminToken string
+	jwt        *JWTVerifier // Verifies identity tokens, nil when JWTs are not configured
+	requireJWT bool         // WebSocket connections must present a JWT
+}
+
+// NewAuthenticator creates an authenticator. When required is false every
+// request without credentials is treated as an anonymous administrator,
+// while invalid credentials are still rejected.
+func NewAuthenticator(tokens *TokenStore, required bool, adminToken string) *Authenticator {
+	return &Authenticator{tokens: tokens, required: required, adminToken: adminToken}
+}
+
+// SetJWTVerifier enables JWT identities, optionally requiring them for WebSocket connections
+func (a *Authenticator) SetJWTVerifier(verifier *JWTVerifier, required bool) {
+	a.jwt = verifier
+	a.requireJWT = required
+}
+
+// Authenticate returns the principal for a request
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	secret, _ := bearerCredential(r)
+	if secret == "" {
+		if a.required {
+			return nil, errNoCredentials
+		}
+		return anonymousPrincipal, nil
+	}
+
+	if a.jwt != nil && looksLikeJWT(secret) {
+		claims, err := a.jwt.Verify(secret)
+		if err != nil {
+			log.Printf("[WARN] Rejected JWT: %v", err)
+			return nil, errInvalidCredentials
+		}
+		return principalFromClaims(claims), nil
+	}
+
+	if a.adminToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(a.adminToken)) == 1 {
+		return &Principal{Subject: "admin", Scopes: []string{scopeServerAdmin}}, nil
+	}
+
+	if token, ok := a.tokens.Lookup(secret); ok {
+		return &Principal{Subject: token.Name, TokenID: token.ID, Scopes: token.Scopes, Roles: token.Roles}, nil
+	}
+	return nil, errInvalidCredentials
+}
+
+// principalFromClaims builds the principal of a verified JWT
+func principalFromClaims(claims *JWTClaims) *Principal {
+	principal := &Principal{
+		Subject: claims.Subject,
+		Name:    claims.Name,
+		Rooms:   claims.Rooms,
+		Roles:   claims.Roles,
+		Scopes:  strings.Fields(claims.Scope),
+	}
+	if principal.Subject == "" {
+		principal.Subject = claims.Name
+	}
+	if principal.Name == "" {
+		principal.Name = claims.Subject
+	}
+	if len(principal.Scopes) == 0 {
+		principal.Scopes = []string{scopeRead, scopeWrite}
+	}
+	return principal
+}
+
+// bearerCredential extracts a bearer token from the Authorization header,
+// the access_token query parameter or the Sec-WebSocket-Protocol header.
+// The second result reports whether the subprotocol form was used.
+func bearerCredential(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):]), false
+	}
+
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, false
+	}
+
+	// Browsers cannot set headers on WebSocket requests, so the token may be
+	// offered as the subprotocol pair "bearer", "<token>"
+	protocols := websocketSubprotocols(r)
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == bearerSubprotocol {
+			return protocols[i+1], true
+		}
+	}
+	return "", false
+}
+
+// bearerSubprotocol is the WebSocket subprotocol that precedes a token
+const bearerSubprotocol = "bearer"
+
+// websocketSubprotocols returns the subprotocols offered by a WebSocket request
+func websocketSubprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// requireScope wraps a handler so it only runs for principals with scope
+func requireScope(auth *Authenticator, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bushitsu"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if !principal.HasScope(scope) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("%s scope required", scope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireModerator wraps a handler that needs an authenticated principal with
+// the moderate scope, as on the WebSocket
+func requireModerator(auth *Authenticator, next http.HandlerFunc) http.HandlerFunc {
+	return requireAuthenticated(auth, scopeModerate, next)
+}
+
+// requireAuthenticated wraps a handler that needs a principal with scope that
+// presented a token or JWT. Anonymous clients are refused even though they
+// hold every scope when tokens are not required
+func requireAuthenticated(auth *Authenticator, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bushitsu"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if principal == anonymousPrincipal || !principal.HasScope(scope) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("%s scope required", scope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// maxTokenRoleLength limits the roles given to an API token
+const maxTokenRoleLength = 64
+
+// Token API types
+type CreateTokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	Roles     []string `json:"roles,omitempty"`
+	ExpiresIn int      `json:"expiresIn,omitempty"` // Lifetime in seconds, 0 never expires
+}
+
+type CreateTokenResponse struct {
+	Token string `json:"token"` // The secret, only returned once
+	APIToken
+}
+
+type TokensResponse struct {
+	Tokens []APIToken `json:"tokens"`
+}
+
+// handleCreateToken handles POST /api/tokens
+func handleCreateToken(tokens *TokenStore, w http.ResponseWriter, r *http.Request) {
+	var req CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "Token name is required")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown scope: %s", scope))
+			return
+		}
+	}
+	for _, role := range req.Roles {
+		if role == "" || len(role) > maxTokenRoleLength || validateChars(role) != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid role: %q", role))
+			return
+		}
+	}
+	if req.ExpiresIn < 0 {
+		writeError(w, http.StatusBadRequest, "expiresIn must not be negative")
+		return
+	}
+
+	secret, token, err := tokens.Issue(req.Name, req.Scopes, req.Roles, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		log.Printf("[ERROR] Failed to issue token: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to issue token")
+		return
+	}
+
+	log.Printf("[INFO] API token issued: id=%s, name=%s, scopes=%v, roles=%v", token.ID, token.Name, token.Scopes, token.Roles)
+	token.Hash = ""
+	writeJSON(w, http.StatusCreated, CreateTokenResponse{Token: secret, APIToken: token})
+}
+
+// handleGetTokens handles GET /api/tokens
+func handleGetTokens(tokens *TokenStore, w http.ResponseWriter, r *http.Request) {
+	list := tokens.List()
+	for i := range list {
+		list[i].Hash = ""
+	}
+	writeJSON(w, http.StatusOK, TokensResponse{Tokens: list})
+}
+
+// handleRevokeToken handles DELETE /api/tokens/{id}
+func handleRevokeToken(hub *Hub, tokens *TokenStore, w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := tokens.Revoke(id); err != nil {
+		if errors.Is(err, errTokenNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("[ERROR] Failed to revoke token: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+
+	// Drop live connections that were opened with the revoked token
+	n := hub.Disconnect(func(c *Client) bool { return c.principal.TokenID == id }, closeRevoked, "token revoked")
+	log.Printf("[INFO] API token revoked: id=%s (%d connections closed)", id, n)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "revoked", "id": id})
+}
@@ -7,16 +7,30 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
 )
 
 const (
-	writeWait        = 10 * time.Second
-	pongWait         = 60 * time.Second
-	pingPeriod       = 30 * time.Second
-	maxMessageSize   = 512 * 1024
-	maxMessageLength = 4096 // Maximum text message length
+	writeWait           = 10 * time.Second
+	pongWait            = 60 * time.Second
+	pingPeriod          = 30 * time.Second
+	maxMessageSize      = 512 * 1024
+	maxMessageLength    = 4096 // Maximum text message length
+	maxReactionLength   = 64   // Maximum reaction (emoji or short code) length in bytes
+	maxMessageReactions = 32   // Maximum number of distinct reactions per message
+)
+
+// Application close codes sent to clients
+const (
+	closeRoomClosed  = 4001 // The room was deleted or renamed
+	closeRevoked     = 4002 // The credentials of the connection were revoked
+	closeNameTaken   = 4003 // The name is already in use in the room
+	closeRateLimited = 4004 // The client exceeded a rate limit with the disconnect action
+	closeKicked      = 4005 // A moderator kicked the client
+	closeBanned      = 4006 // A moderator banned the client
+	closeRoomFull    = 4007 // The room is full
 )
 
 // WebSocketMessage represents all messages sent between server and client
@@ -24,7 +38,15 @@ type WebSocketMessage struct {
 	Type      string      `json:"type"`
 	Room      string      `json:"room"`
 	Timestamp string      `json:"timestamp"`
+	ID        string      `json:"id,omitempty"`  // Server-assigned message ID
+	Seq       uint64      `json:"seq,omitempty"` // Per-room sequence number
 	Data      interface{} `json:"data"`
+
+	// Set on messages sent by a client so the hub can reply to it
+	origin      *Client `json:"-"`
+	clientMsgID string  `json:"-"`
+	holdReason  string  `json:"-"` // Why a content filter held the message for review
+	reviewed    bool    `json:"-"` // A moderator approved the message
 }
 
 // ChatData represents chat message data
@@ -33,12 +55,59 @@ type ChatData struct {
 	FromId  string   `json:"fromId"`
 	Text    string   `json:"text"`
 	Mention []string `json:"mention,omitempty"`
+	To      string   `json:"to,omitempty"` // Recipient of a whisper or direct message
+	Profile          // Profile of the sender when the message was sent
+
+	Metadata    json.RawMessage `json:"metadata,omitempty"` // Application-defined JSON object, passed through unchanged
+	Attachments []Attachment    `json:"attachments,omitempty"`
+}
+
+// ChatUpdatedData represents an edit of a chat message
+type ChatUpdatedData struct {
+	ID       string   `json:"id"`
+	Seq      uint64   `json:"seq"`
+	Revision int      `json:"revision"`
+	Text     string   `json:"text"`
+	Mention  []string `json:"mention,omitempty"`
+	EditedBy string   `json:"editedBy"`
+}
+
+// ChatDeletedData represents the deletion of a chat message
+type ChatDeletedData struct {
+	ID        string `json:"id"`
+	Seq       uint64 `json:"seq"`
+	DeletedBy string `json:"deletedBy"`
+}
+
+// ReactionUpdateData represents the current reaction totals of a chat message
+type ReactionUpdateData struct {
+	ID        string         `json:"id"`
+	Seq       uint64         `json:"seq"`
+	User      string         `json:"user"`
+	Reaction  string         `json:"reaction"`
+	Removed   bool           `json:"removed,omitempty"`
+	Reactions map[string]int `json:"reactions"` // Number of users per reaction
 }
 
 // UserEventData represents user join/leave events
 type UserEventData struct {
-	Event string `json:"event"` // "join" or "leave"
-	User  string `json:"user"`
+	Event  string      `json:"event"` // "join", "leave" or "profile_updated"
+	User   string      `json:"user"`
+	Member *MemberInfo `json:"member,omitempty"` // The member that joined, left or changed its profile
+}
+
+// MemberInfo describes a client connected to a room
+type MemberInfo struct {
+	Name       string `json:"name"`
+	SessionId  string `json:"sessionId"`
+	JoinedAt   string `json:"joinedAt"`
+	ClientType string `json:"clientType,omitempty"` // e.g. "human", "bot" or "overlay", as given by the client
+	Profile
+}
+
+// RosterData represents the members of a room
+type RosterData struct {
+	Members []MemberInfo `json:"members"`
 }
 
 // SystemEventData represents system events
@@ -51,6 +120,25 @@ type SystemEventData struct {
 type ClientMessage struct {
 	Type string `json:"type"`
 	Text string `json:"text,omitempty"`
+	To   string `json:"to,omitempty"` // Recipient of a whisper or direct message
+	ID   string `json:"id,omitempty"` // Message to edit, delete or react to
+
+	Reaction string `json:"reaction,omitempty"`
+	Remove   bool   `json:"remove,omitempty"` // Withdraw the reaction instead of adding it
+	State    string `json:"state,omitempty"`  // Typing state
+
+	Profile *ProfileUpdate `json:"profile,omitempty"` // Profile fields to set with hello
+
+	Moderation *ModerationRequest `json:"moderation,omitempty"` // Command of a moderate message
+	Review     *ReviewRequest     `json:"review,omitempty"`     // Decision on a pending message
+
+	Metadata    json.RawMessage `json:"metadata,omitempty"`
+	Attachments []Attachment    `json:"attachments,omitempty"`
+
+	Payload json.RawMessage `json:"payload,omitempty"` // Payload of a custom message type
+	Targets []string        `json:"targets,omitempty"` // Recipients of a custom message type with targets scope
+
+	ClientMsgID string `json:"clientMsgId,omitempty"` // Client-chosen ID echoed in the ack or error reply
 }
 
 type Client struct {
@@ -60,11 +148,28 @@ type Client struct {
 	send      chan []byte
 	room      string
 	name      string
+	ip        string // Remote address, or the forwarded address behind a trusted proxy
+	principal *Principal
 	closeOnce sync.Once
+	closeMsg  []byte    // Close frame payload sent when the send channel is closed
+	admitted  chan bool // Receives whether the hub accepted the client under the room's member limit and name policy
+	typing    typingIndicator
+
+	joinedAt   time.Time // When the client joined its current room
+	clientType string
+	profile    Profile
+
+	historySize int    // Messages to replay on join, negative uses the room default
+	resume      bool   // Replay the messages after since instead of recent history
+	since       uint64 // Last sequence number the client received
 }
 
 func (c *Client) readLoop() {
 	defer func() {
+		// Clear a typing, thinking or speaking state left behind
+		if c.typing.stop() {
+			c.sendTyping(typingStop)
+		}
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
@@ -85,42 +190,180 @@ func (c *Client) readLoop() {
 			break
 		}
 
+		// Fields of the wrong type leave the rest of the message decoded, so
+		// the clientMsgId can still be echoed in the error
 		var clientMsg ClientMessage
 		if err := json.Unmarshal(message, &clientMsg); err != nil {
 			log.Printf("[ERROR] json unmarshal error: %v", err)
+			c.reject(validClientMsgID(clientMsg.ClientMsgID), errorInvalidJSON, "invalid JSON message")
+			continue
+		}
+		if validClientMsgID(clientMsg.ClientMsgID) != clientMsg.ClientMsgID {
+			log.Printf("[ERROR] invalid message from %s: invalid clientMsgId", c.name)
+			c.reject("", errorInvalidMessage, "invalid clientMsgId")
 			continue
 		}
 		
-		// Validate message
-		if err := validateMessage(clientMsg); err != nil {
+		// Validate message, custom types are checked against their definition
+		customType, isCustom := c.hub.MessageType(clientMsg.Type)
+		if isCustom {
+			err = customType.validate(clientMsg)
+		} else {
+			err = validateMessage(clientMsg)
+		}
+		if maxSize := c.hub.MaxMetadataSize(); err == nil && len(clientMsg.Metadata) > maxSize {
+			err = newClientError(errorTooLong, "metadata must be at most %d bytes", maxSize)
+		}
+		if err != nil {
 			log.Printf("[ERROR] invalid message from %s: %v", c.name, err)
+			c.reject(clientMsg.ClientMsgID, errorCode(err), err.Error())
 			continue
 		}
 
-		// Convert client message to server message format
-		if clientMsg.Type == "chat" {
-			// Parse mentions
-			var mentions []string
-			if strings.HasPrefix(clientMsg.Text, "@") {
-				parts := strings.SplitN(clientMsg.Text, " ", 2)
-				if len(parts) > 0 {
-					mentions = append(mentions, strings.TrimPrefix(parts[0], "@"))
-				}
+		if !c.principal.HasScope(scopeWrite) {
+			log.Printf("[WARN] Dropped message from %s: write scope required", c.name)
+			c.reject(clientMsg.ClientMsgID, errorForbidden, "write scope required")
+			continue
+		}
+
+		// Muted users may still read but not send
+		if sanction, muted := c.hub.Moderation().Muted(c.currentRoom(), c.name); muted {
+			message := "you are muted"
+			if sanction.ExpiresAt != nil {
+				message += " until " + sanction.ExpiresAt.Format(time.RFC3339)
 			}
+			c.reject(clientMsg.ClientMsgID, errorMuted, message)
+			continue
+		}
+
+		// Typing states are throttled separately and not counted
+		if clientMsg.Type != "typing" && !c.allowMessage(clientMsg.ClientMsgID) {
+			continue
+		}
+
+		// Content filters may rewrite the text, hold the message for review or reject it
+		holdReason, ok := c.applyFilters(&clientMsg)
+		if !ok {
+			continue
+		}
 
+		// Convert client message to server message format
+		switch clientMsg.Type {
+		case "chat":
 			wsMsg := WebSocketMessage{
 				Type:      "chat",
-				Room:      c.room,
+				Room:      c.currentRoom(),
 				Timestamp: time.Now().UTC().Format(time.RFC3339),
 				Data: ChatData{
 					From:    c.name,
 					FromId:  c.id,
 					Text:    clientMsg.Text,
-					Mention: mentions,
+					Mention: parseMentions(clientMsg.Text),
+					Profile: c.currentProfile(),
+
+					Metadata:    clientMsg.Metadata,
+					Attachments: clientMsg.Attachments,
 				},
+				holdReason: holdReason,
 			}
 			
-			c.hub.broadcast <- wsMsg
+			c.submit(wsMsg, clientMsg.ClientMsgID)
+
+		case "dm":
+			if !c.hub.DirectMessagesAllowed() {
+				log.Printf("[WARN] Dropped direct message from %s: direct messages are disabled", c.name)
+				c.reject(clientMsg.ClientMsgID, errorForbidden, "direct messages are disabled")
+				continue
+			}
+			if !c.principal.HasScope(scopeDM) {
+				log.Printf("[WARN] Dropped direct message from %s: dm scope required", c.name)
+				c.reject(clientMsg.ClientMsgID, errorForbidden, "dm scope required")
+				continue
+			}
+			fallthrough
+
+		case "whisper":
+			c.submit(WebSocketMessage{
+				Type:      clientMsg.Type,
+				Room:      c.currentRoom(),
+				Timestamp: time.Now().UTC().Format(time.RFC3339),
+				Data: ChatData{
+					From:    c.name,
+					FromId:  c.id,
+					Text:    clientMsg.Text,
+					To:      clientMsg.To,
+					Profile: c.currentProfile(),
+
+					Metadata:    clientMsg.Metadata,
+					Attachments: clientMsg.Attachments,
+				},
+				holdReason: holdReason,
+			}, clientMsg.ClientMsgID)
+
+		case "edit", "delete":
+			c.submit(WebSocketMessage{
+				Type:      clientMsg.Type,
+				Room:      c.currentRoom(),
+				Timestamp: time.Now().UTC().Format(time.RFC3339),
+				Data: messageChange{
+					ID:        clientMsg.ID,
+					Text:      clientMsg.Text,
+					Delete:    clientMsg.Type == "delete",
+					SessionID: c.id,
+					Name:      c.name,
+					Moderator: c.principal.IsModerator(),
+				},
+			}, clientMsg.ClientMsgID)
+
+		case "typing":
+			c.setTyping(clientMsg.State)
+			c.acknowledge(clientMsg.ClientMsgID)
+
+		case "hello":
+			if err := clientMsg.Profile.allowedFor(c.principal); err != nil {
+				log.Printf("[WARN] Dropped profile update from %s: %v", c.name, err)
+				c.reject(clientMsg.ClientMsgID, errorForbidden, err.Error())
+				continue
+			}
+			c.submit(WebSocketMessage{
+				Type:      "hello",
+				Room:      c.currentRoom(),
+				Timestamp: time.Now().UTC().Format(time.RFC3339),
+				Data:      profileChange{client: c, update: *clientMsg.Profile},
+			}, clientMsg.ClientMsgID)
+
+		case "reaction":
+			c.submit(WebSocketMessage{
+				Type:      "reaction",
+				Room:      c.currentRoom(),
+				Timestamp: time.Now().UTC().Format(time.RFC3339),
+				Data: reactionChange{
+					ID:       clientMsg.ID,
+					Reaction: clientMsg.Reaction,
+					Remove:   clientMsg.Remove,
+					Name:     c.name,
+				},
+			}, clientMsg.ClientMsgID)
+
+		case "moderate":
+			c.moderate(*clientMsg.Moderation, clientMsg.ClientMsgID)
+
+		case "review":
+			c.review(*clientMsg.Review, clientMsg.ClientMsgID)
+
+		default:
+			// Only registered custom types get past validation
+			c.submit(WebSocketMessage{
+				Type:      clientMsg.Type,
+				Room:      c.currentRoom(),
+				Timestamp: time.Now().UTC().Format(time.RFC3339),
+				Data: CustomData{
+					From:    c.name,
+					FromId:  c.id,
+					Targets: clientMsg.Targets,
+					Payload: clientMsg.Payload,
+				},
+			}, clientMsg.ClientMsgID)
 		}
 	}
 }
@@ -138,7 +381,7 @@ func (c *Client) writeLoop() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				log.Printf("[INFO] Send channel closed for client %s", c.name)
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg)
 				return
 			}
 
@@ -157,6 +400,22 @@ func (c *Client) writeLoop() {
 	}
 }
 
+// submit hands a message of the client to the hub, which acknowledges it
+// when it has a clientMsgId
+func (c *Client) submit(msg WebSocketMessage, clientMsgID string) {
+	msg.origin = c
+	msg.clientMsgID = clientMsgID
+	c.hub.broadcast <- msg
+}
+
+// validClientMsgID returns id if it is usable as a clientMsgId, otherwise ""
+func validClientMsgID(id string) string {
+	if len(id) > maxClientMsgIDLength || validateChars(id) != nil {
+		return ""
+	}
+	return id
+}
+
 // close safely closes the client connection and channels
 func (c *Client) close() {
 	c.closeOnce.Do(func() {
@@ -165,28 +424,179 @@ func (c *Client) close() {
 	})
 }
 
+// disconnect closes the connection with a close code after flushing queued messages
+func (c *Client) disconnect(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.send)
+	})
+}
+
+// trySend queues a message without blocking, dropping it when the send
+// buffer is full. Clients are closed with the hub's write lock held, so the
+// caller must hold the read lock of a client that is still in the hub to
+// keep the send channel open
+func (c *Client) trySend(data []byte, kind string) {
+	select {
+	case c.send <- data:
+	default:
+		log.Printf("[WARN] Send buffer full, dropping %s for client %s", kind, c.name)
+	}
+}
+
+// memberInfo describes the client, must be called from the hub loop or with the hub lock held
+func (c *Client) memberInfo() MemberInfo {
+	return MemberInfo{
+		Name:       c.name,
+		SessionId:  c.id,
+		JoinedAt:   c.joinedAt.Format(time.RFC3339),
+		ClientType: c.clientType,
+		Profile:    c.profile,
+	}
+}
+
+// currentProfile returns the profile of the client, which the hub may change
+func (c *Client) currentProfile() Profile {
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	return c.profile
+}
+
+// currentRoom returns the room the client is in, which the hub may change
+func (c *Client) currentRoom() string {
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	return c.room
+}
+
+// parseMentions returns the distinct names mentioned in text, in order of
+// appearance. A mention is @name, or @"first last" for names with spaces,
+// and must not directly follow a name character (as in mail addresses)
+func parseMentions(text string) []string {
+	var mentions []string
+	seen := make(map[string]bool)
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' || (i > 0 && isMentionRune(runes[i-1])) {
+			continue
+		}
+
+		var name string
+		if i+1 < len(runes) && runes[i+1] == '"' {
+			// Quoted name, ignored when the closing quote is missing
+			end := i + 2
+			for end < len(runes) && runes[end] != '"' && runes[end] != '\n' {
+				end++
+			}
+			if end == len(runes) || runes[end] != '"' {
+				continue
+			}
+			name = strings.TrimSpace(string(runes[i+2 : end]))
+			i = end
+		} else {
+			end := i + 1
+			for end < len(runes) && isMentionRune(runes[end]) {
+				end++
+			}
+			// Punctuation ending a sentence is not part of the name
+			name = strings.TrimRight(string(runes[i+1:end]), ".-")
+			i = end - 1
+		}
+
+		if name != "" && !seen[name] {
+			seen[name] = true
+			mentions = append(mentions, name)
+		}
+	}
+	return mentions
+}
+
+// isMentionRune reports whether r may be part of an unquoted mentioned name
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || strings.ContainsRune("_-.#", r)
+}
+
 // validateMessage validates incoming client messages
 func validateMessage(msg ClientMessage) error {
 	// Check message type
-	if msg.Type != "chat" {
-		return errors.New("invalid message type")
+	switch msg.Type {
+	case "chat", "whisper", "dm", "edit":
+	case "delete":
+		if msg.ID == "" {
+			return errors.New("delete requires a message id")
+		}
+		return nil
+	case "reaction":
+		if msg.ID == "" {
+			return errors.New("reaction requires a message id")
+		}
+		if len(msg.Reaction) == 0 {
+			return errors.New("empty reaction")
+		}
+		if len(msg.Reaction) > maxReactionLength {
+			return newClientError(errorTooLong, "reaction must be at most %d bytes", maxReactionLength)
+		}
+		if strings.IndexFunc(msg.Reaction, unicode.IsSpace) >= 0 {
+			return errors.New("reaction must not contain spaces")
+		}
+		return validateChars(msg.Reaction)
+	case "typing":
+		if !validTypingState(msg.State) {
+			return errors.New("invalid typing state")
+		}
+		return nil
+	case "hello":
+		if msg.Profile == nil {
+			return errors.New("hello requires a profile")
+		}
+		return msg.Profile.validate()
+	case "moderate":
+		if msg.Moderation == nil {
+			return errors.New("moderate requires a moderation command")
+		}
+		return msg.Moderation.validate()
+	case "review":
+		if msg.Review == nil {
+			return errors.New("review requires a review decision")
+		}
+		return msg.Review.validate()
+	default:
+		return errUnknownType
+	}
+	
+	if (msg.Type == "whisper" || msg.Type == "dm") && msg.To == "" {
+		return errors.New("private message requires a recipient")
 	}
 	
-	// Check text length
-	if len(msg.Text) == 0 {
+	if msg.Type == "edit" && msg.ID == "" {
+		return errors.New("edit requires a message id")
+	}
+
+	if msg.Type != "edit" {
+		if err := validatePayload(msg.Metadata, msg.Attachments); err != nil {
+			return err
+		}
+	}
+	
+	// Check text length, messages with attachments may omit the text
+	if len(msg.Text) == 0 && (msg.Type == "edit" || len(msg.Attachments) == 0) {
 		return errors.New("empty message")
 	}
 	
 	if len(msg.Text) > maxMessageLength {
-		return errors.New("message too long")
+		return errMessageTooLong
 	}
 	
 	// Check for control characters
-	for _, r := range msg.Text {
+	return validateChars(msg.Text)
+}
+
+// validateChars rejects control characters other than tab, newline and carriage return
+func validateChars(text string) error {
+	for _, r := range text {
 		if r < 32 && r != '\t' && r != '\n' && r != '\r' {
-			return errors.New("invalid characters in message")
+			return errInvalidChars
 		}
 	}
-	
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"no mention", "hello everyone", nil},
+		{"single", "hello @alice", []string{"alice"}},
+		{"order and duplicates", "@bob @alice @bob", []string{"bob", "alice"}},
+		{"mail address", "mail me at user@example.com", nil},
+		{"trailing period", "thanks @alice.", []string{"alice"}},
+		{"trailing hyphen", "@alice- see you", []string{"alice"}},
+		{"inner period and hyphen", "@ai.chan-2 hi", []string{"ai.chan-2"}},
+		{"comma", "@alice, @bob, hi", []string{"alice", "bob"}},
+		{"parentheses", "(@alice)", []string{"alice"}},
+		{"hash", "@user#1234 hi", []string{"user#1234"}},
+		{"japanese", "@あいちゅーばー こんにちは", []string{"あいちゅーばー"}},
+		{"combining mark", "@cafe\u0301 hi", []string{"cafe\u0301"}},
+		{"quoted", `@"Taro Yamada" hi`, []string{"Taro Yamada"}},
+		{"quoted trimmed", `@"  alice  " hi`, []string{"alice"}},
+		{"quoted empty", `@"" hi`, nil},
+		{"quoted unterminated", `@"Taro Yamada hi`, nil},
+		{"quoted across lines", "@\"Taro\nYamada\" hi", nil},
+		{"bare at sign", "@ alone", nil},
+		{"double at sign", "@@alice", []string{"alice"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMentions(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("parseMentions(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Filter verdicts
+const (
+	filterPass    = "pass"    // Deliver the message unchanged
+	filterRewrite = "rewrite" // Deliver the rewritten text
+	filterHold    = "hold"    // Withhold the message for review
+	filterReject  = "reject"  // Drop the message and tell the sender why
+)
+
+// Actions of filter rules that match
+const (
+	filterActionMask   = "mask"
+	filterActionHold   = "hold"
+	filterActionReject = "reject"
+)
+
+const (
+	blocklistPollInterval = 2 * time.Second // How often the blocklist file is checked for changes
+	maskedLink            = "[link]"        // Replacement of masked URLs
+)
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// FilterInput is the text of a client message and its sender
+type FilterInput struct {
+	Type      string // "chat", "whisper", "dm" or "edit"
+	Room      string
+	Name      string
+	SessionID string
+	Text      string
+}
+
+// FilterResult is the verdict of a filter on a message
+type FilterResult struct {
+	Verdict string
+	Text    string // Rewritten text for the rewrite and hold verdicts, empty keeps the text
+	Reason  string // Why the message was held or rejected
+}
+
+// ContentFilter checks the text of client messages. Filters are called from
+// every client goroutine and must be safe for concurrent use
+type ContentFilter interface {
+	Name() string
+	Filter(msg FilterInput) FilterResult
+}
+
+// FilterChain runs content filters in order. Each filter sees the text as
+// rewritten by the filters before it, and the first hold or reject ends the
+// chain with the text rewritten so far
+type FilterChain struct {
+	filters []ContentFilter
+}
+
+// Use appends a filter to the chain
+func (c *FilterChain) Use(filter ContentFilter) {
+	c.filters = append(c.filters, filter)
+}
+
+// Len returns the number of filters in the chain
+func (c *FilterChain) Len() int {
+	return len(c.filters)
+}
+
+// Run filters a message and returns the combined verdict
+func (c *FilterChain) Run(msg FilterInput) FilterResult {
+	original := msg.Text
+	for _, filter := range c.filters {
+		result := filter.Filter(msg)
+		switch result.Verdict {
+		case filterRewrite:
+			msg.Text = result.Text
+		case filterHold, filterReject:
+			if result.Reason == "" {
+				result.Reason = fmt.Sprintf("%s filter", filter.Name())
+			}
+			if result.Text == "" {
+				result.Text = msg.Text
+			}
+			return result
+		}
+	}
+	if msg.Text != original {
+		return FilterResult{Verdict: filterRewrite, Text: msg.Text}
+	}
+	return FilterResult{Verdict: filterPass, Text: msg.Text}
+}
+
+// validFilterAction reports whether action is a known filter rule action
+func validFilterAction(action string) bool {
+	switch action {
+	case filterActionMask, filterActionHold, filterActionReject:
+		return true
+	}
+	return false
+}
+
+// blockRule is one entry of the blocklist
+type blockRule struct {
+	pattern *regexp.Regexp
+	action  string
+}
+
+// BlocklistFilter masks, holds or rejects text matching the words and
+// regular expressions of a blocklist file, which is reloaded when it changes
+type BlocklistFilter struct {
+	mu      sync.RWMutex
+	path    string
+	rules   []blockRule
+	modTime time.Time
+	size    int64
+}
+
+// NewBlocklistFilter loads a blocklist file and watches it for changes
+func NewBlocklistFilter(path string) (*BlocklistFilter, error) {
+	f := &BlocklistFilter{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	go f.watch()
+	return f, nil
+}
+
+// parseBlocklist parses a blocklist. Each line holds a word or a /regex/,
+// optionally prefixed by "mask:", "hold:" or "reject:" (mask by default).
+// Words match case-insensitively as whole words, so "ass" leaves "class"
+// alone, while regexes match anywhere. Empty lines and lines starting with #
+// are ignored
+func parseBlocklist(data []byte) ([]blockRule, error) {
+	var rules []blockRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		action := filterActionMask
+		if prefix, rest, ok := strings.Cut(line, ":"); ok && validFilterAction(prefix) {
+			action, line = prefix, strings.TrimSpace(rest)
+		}
+
+		var expr string
+		if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+			expr = "(?i)" + line[1:len(line)-1]
+		} else if line != "" {
+			expr = "(?i)" + wordPattern(line)
+		} else {
+			return nil, fmt.Errorf("line %d: empty entry", n)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, blockRule{pattern: pattern, action: action})
+	}
+	return rules, scanner.Err()
+}
+
+// wordPattern returns a regular expression matching word as a whole word.
+// \b only knows ASCII word characters, so edges of other characters, such as
+// Japanese words that are written without spaces, match anywhere
+func wordPattern(word string) string {
+	expr := regexp.QuoteMeta(word)
+	if isWordChar(word[0]) {
+		expr = `\b` + expr
+	}
+	if isWordChar(word[len(word)-1]) {
+		expr += `\b`
+	}
+	return expr
+}
+
+// isWordChar reports whether b is an ASCII word character as defined by \w
+func isWordChar(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// reload reads the blocklist file if it changed since the last load
+func (f *BlocklistFilter) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read blocklist: %w", err)
+	}
+
+	f.mu.RLock()
+	unchanged := info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read blocklist: %w", err)
+	}
+	rules, err := parseBlocklist(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse blocklist: %w", err)
+	}
+
+	f.mu.Lock()
+	f.rules = rules
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.mu.Unlock()
+	log.Printf("[INFO] Loaded %d blocklist entries from %s", len(rules), f.path)
+	return nil
+}
+
+// watch reloads the blocklist when the file changes. A broken file keeps
+// the previous entries in place
+func (f *BlocklistFilter) watch() {
+	ticker := time.NewTicker(blocklistPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := f.reload(); err != nil {
+			log.Printf("[ERROR] Blocklist not reloaded: %v", err)
+		}
+	}
+}
+
+// Name returns the name of the filter
+func (f *BlocklistFilter) Name() string {
+	return "blocklist"
+}
+
+// Filter applies the blocklist to a message
+func (f *BlocklistFilter) Filter(msg FilterInput) FilterResult {
+	f.mu.RLock()
+	rules := f.rules
+	f.mu.RUnlock()
+
+	text := msg.Text
+	hold := false
+	for _, rule := range rules {
+		if !rule.pattern.MatchString(text) {
+			continue
+		}
+		switch rule.action {
+		case filterActionReject:
+			return FilterResult{Verdict: filterReject, Reason: "message contains a blocked word"}
+		case filterActionHold:
+			hold = true
+		default:
+			text = rule.pattern.ReplaceAllStringFunc(text, func(match string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(match))
+			})
+		}
+	}
+
+	if hold {
+		return FilterResult{Verdict: filterHold, Text: text, Reason: "message contains a word that needs review"}
+	}
+	if text != msg.Text {
+		return FilterResult{Verdict: filterRewrite, Text: text}
+	}
+	return FilterResult{Verdict: filterPass}
+}
+
+// URLFilter checks the links in a message against allowed and denied
+// domains. A domain also covers its subdomains
+type URLFilter struct {
+	allow  []string // When set, only links to these domains are accepted
+	deny   []string
+	action string // "mask", "hold" or "reject"
+}
+
+// NewURLFilter creates a URL filter from lists of domains
+func NewURLFilter(allow, deny []string, action string) (*URLFilter, error) {
+	if !validFilterAction(action) {
+		return nil, fmt.Errorf("URL filter action must be mask, hold or reject")
+	}
+	normalize := func(domains []string) []string {
+		var result []string
+		for _, domain := range domains {
+			if domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), "."); domain != "" {
+				result = append(result, domain)
+			}
+		}
+		return result
+	}
+	return &URLFilter{allow: normalize(allow), deny: normalize(deny), action: action}, nil
+}
+
+// Name returns the name of the filter
+func (f *URLFilter) Name() string {
+	return "url"
+}
+
+// allowed reports whether a link may be posted
+func (f *URLFilter) allowed(link string) bool {
+	if !strings.Contains(strings.ToLower(link), "://") {
+		link = "http://" + link
+	}
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Hostname() == "" {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+
+	covers := func(domains []string) bool {
+		for _, domain := range domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+		return false
+	}
+	if covers(f.deny) {
+		return false
+	}
+	return len(f.allow) == 0 || covers(f.allow)
+}
+
+// Filter applies the domain lists to the links of a message
+func (f *URLFilter) Filter(msg FilterInput) FilterResult {
+	blocked := false
+	text := linkPattern.ReplaceAllStringFunc(msg.Text, func(link string) string {
+		if f.allowed(link) {
+			return link
+		}
+		blocked = true
+		return maskedLink
+	})
+	if !blocked {
+		return FilterResult{Verdict: filterPass}
+	}
+
+	switch f.action {
+	case filterActionReject:
+		return FilterResult{Verdict: filterReject, Reason: "links to this site are not allowed"}
+	case filterActionHold:
+		return FilterResult{Verdict: filterHold, Reason: "message contains a link that needs review"}
+	}
+	return FilterResult{Verdict: filterRewrite, Text: text}
+}
+
+// spamEntry is a recent message of a sender
+type spamEntry struct {
+	text string
+	at   time.Time
+}
+
+// SpamFilter rejects a sender repeating the same message and shortens
+// floods of a repeated character
+type SpamFilter struct {
+	mu         sync.Mutex
+	maxRepeats int // Identical messages allowed per window, 0 disables the check
+	window     time.Duration
+	maxRun     int                    // Longest run of one character, 0 disables the check
+	recent     map[string][]spamEntry // Keyed by room and name
+	lastSweep  time.Time
+}
+
+// NewSpamFilter creates a spam filter
+func NewSpamFilter(maxRepeats int, window time.Duration, maxRun int) *SpamFilter {
+	return &SpamFilter{
+		maxRepeats: maxRepeats,
+		window:     window,
+		maxRun:     maxRun,
+		recent:     make(map[string][]spamEntry),
+		lastSweep:  time.Now(),
+	}
+}
+
+// Name returns the name of the filter
+func (f *SpamFilter) Name() string {
+	return "spam"
+}
+
+// Filter checks a message for repetition and character floods. Edits are
+// only checked for floods
+func (f *SpamFilter) Filter(msg FilterInput) FilterResult {
+	if f.maxRepeats > 0 && msg.Type != "edit" && f.repeated(msg) {
+		return FilterResult{Verdict: filterReject, Reason: "repeated message"}
+	}
+	if f.maxRun > 0 {
+		if text := shortenRuns(msg.Text, f.maxRun); text != msg.Text {
+			return FilterResult{Verdict: filterRewrite, Text: text}
+		}
+	}
+	return FilterResult{Verdict: filterPass}
+}
+
+// repeated records a message and reports whether its sender already sent
+// it maxRepeats times within the window
+func (f *SpamFilter) repeated(msg FilterInput) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.lastSweep) > f.window {
+		for key, entries := range f.recent {
+			if len(entries) == 0 || now.Sub(entries[len(entries)-1].at) > f.window {
+				delete(f.recent, key)
+			}
+		}
+		f.lastSweep = now
+	}
+
+	key := msg.Room + "\x00" + msg.Name
+	text := strings.ToLower(strings.Join(strings.Fields(msg.Text), " "))
+	kept := f.recent[key][:0]
+	count := 0
+	for _, entry := range f.recent[key] {
+		if now.Sub(entry.at) > f.window {
+			continue
+		}
+		kept = append(kept, entry)
+		if entry.text == text {
+			count++
+		}
+	}
+	if count >= f.maxRepeats {
+		f.recent[key] = kept
+		return true
+	}
+	f.recent[key] = append(kept, spamEntry{text: text, at: now})
+	return false
+}
+
+// shortenRuns cuts runs of the same character down to max characters
+func shortenRuns(text string, max int) string {
+	var b strings.Builder
+	var last rune
+	run := 0
+	for _, r := range text {
+		if r == last {
+			run++
+		} else {
+			last, run = r, 1
+		}
+		if run <= max {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// applyFilters runs the content filters over the text of a chat message,
+// whisper, direct message or edit. It rewrites the text in place and returns
+// why the message must be held for review, if it must, and whether it may be
+// sent at all. Held messages keep the masks of the filters before the hold.
+// Rejected messages are answered here
+func (c *Client) applyFilters(msg *ClientMessage) (string, bool) {
+	filters := c.hub.Filters()
+	if filters == nil || msg.Text == "" {
+		return "", true
+	}
+	switch msg.Type {
+	case "chat", "whisper", "dm", "edit":
+	default:
+		return "", true
+	}
+
+	room := c.currentRoom()
+	result := filters.Run(FilterInput{Type: msg.Type, Room: room, Name: c.name, SessionID: c.id, Text: msg.Text})
+	switch result.Verdict {
+	case filterRewrite:
+		msg.Text = result.Text
+	case filterHold:
+		// Edits apply to messages already delivered and cannot wait for review
+		if msg.Type != "edit" {
+			msg.Text = result.Text
+			return result.Reason, true
+		}
+		fallthrough
+	case filterReject:
+		log.Printf("[WARN] Rejected message from %s in room=%s: %s", c.name, room, result.Reason)
+		c.reject(msg.ClientMsgID, errorFiltered, result.Reason)
+		return "", false
+	}
+	return "", true
+}
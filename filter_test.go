@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParseBlocklist(t *testing.T) {
+	tests := []struct {
+		name   string
+		list   string
+		text   string
+		match  bool
+		action string
+	}{
+		{"whole word", "ass", "what an ass", true, filterActionMask},
+		{"inside word", "ass", "first class", false, filterActionMask},
+		{"word prefix", "ass", "assume nothing", false, filterActionMask},
+		{"case insensitive", "ass", "ASS!", true, filterActionMask},
+		{"regex matches anywhere", "/ass/", "first class", true, filterActionMask},
+		{"regex case insensitive", "/sp[a4]m/", "SP4M here", true, filterActionMask},
+		{"hold prefix", "hold: spoiler", "no spoiler please", true, filterActionHold},
+		{"reject prefix", "reject:scam", "a scam link", true, filterActionReject},
+		{"reject prefix whole word", "reject:scam", "scamper away", false, filterActionReject},
+		{"prefixed regex", "hold:/foo\\d+/", "see foo42", true, filterActionHold},
+		{"japanese", "ばか", "あなたはばかですね", true, filterActionMask},
+		{"japanese next to ascii", "ばか", "ばかman", true, filterActionMask},
+		{"unknown prefix is part of the word", "note:ass", "note:ass", true, filterActionMask},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseBlocklist([]byte("# comment\n\n" + tt.list + "\n"))
+			if err != nil {
+				t.Fatalf("parseBlocklist(%q) error: %v", tt.list, err)
+			}
+			if len(rules) != 1 {
+				t.Fatalf("parseBlocklist(%q) = %d rules, want 1", tt.list, len(rules))
+			}
+			if rules[0].action != tt.action {
+				t.Errorf("parseBlocklist(%q) action = %q, want %q", tt.list, rules[0].action, tt.action)
+			}
+			if got := rules[0].pattern.MatchString(tt.text); got != tt.match {
+				t.Errorf("parseBlocklist(%q) matches %q = %v, want %v", tt.list, tt.text, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestParseBlocklistErrors(t *testing.T) {
+	for _, list := range []string{"hold:", "/[/"} {
+		if _, err := parseBlocklist([]byte(list)); err == nil {
+			t.Errorf("parseBlocklist(%q) succeeded, want error", list)
+		}
+	}
+}
@@ -2,4 +2,4 @@ module aituber-onair-bushitsu
 
 go 1.22.3
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"math"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
@@ -13,28 +16,206 @@ import (
 type RoomInfo struct {
 	Name      string `json:"name"`
 	UserCount int    `json:"userCount"`
+	RoomConfig
+}
+
+// Room visibility values
+const (
+	roomVisibilityPublic   = "public"   // Listed by GET /api/rooms
+	roomVisibilityUnlisted = "unlisted" // Joinable by name but not listed
+)
+
+// Policies for a name that is already used by another client in the room
+const (
+	namePolicyAllow     = "allow"     // Duplicate names are allowed
+	namePolicyReject    = "reject"    // The new connection is closed
+	namePolicySuffix    = "suffix"    // The new client is renamed to name#2, name#3, ...
+	namePolicyPrincipal = "principal" // Only sessions of the same authenticated principal may share a name
+)
+
+// validNamePolicy reports whether policy is a known name policy
+func validNamePolicy(policy string) bool {
+	switch policy {
+	case namePolicyAllow, namePolicyReject, namePolicySuffix, namePolicyPrincipal:
+		return true
+	}
+	return false
+}
+
+// RoomConfig holds the settings and metadata of a predefined room
+type RoomConfig struct {
+	HistorySize *int              `json:"history,omitempty"` // Number of messages replayed on join
+	Topic       string            `json:"topic,omitempty"`
+	Description string            `json:"description,omitempty"`
+	MaxMembers  int               `json:"maxMembers,omitempty"` // 0 means unlimited
+	Visibility  string            `json:"visibility,omitempty"` // "public" (default) or "unlisted"
+	NamePolicy  string            `json:"namePolicy,omitempty"` // Overrides the server-wide name policy
+	Moderated   bool              `json:"moderated,omitempty"`  // Chat messages wait for a moderator's approval
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// RoomUpdate holds the room settings to change, nil fields are left unchanged
+type RoomUpdate struct {
+	HistorySize *int               `json:"history,omitempty"`
+	Topic       *string            `json:"topic,omitempty"`
+	Description *string            `json:"description,omitempty"`
+	MaxMembers  *int               `json:"maxMembers,omitempty"`
+	Visibility  *string            `json:"visibility,omitempty"`
+	NamePolicy  *string            `json:"namePolicy,omitempty"`
+	Moderated   *bool              `json:"moderated,omitempty"`
+	Attributes  map[string]*string `json:"attributes,omitempty"` // A null value removes the attribute
+}
+
+// empty reports whether the update changes nothing
+func (u RoomUpdate) empty() bool {
+	return u.HistorySize == nil && u.Topic == nil && u.Description == nil &&
+		u.MaxMembers == nil && u.Visibility == nil && u.NamePolicy == nil && u.Moderated == nil && len(u.Attributes) == 0
+}
+
+// apply returns a copy of config with the update applied
+func (u RoomUpdate) apply(config RoomConfig) RoomConfig {
+	if u.HistorySize != nil {
+		config.HistorySize = u.HistorySize
+	}
+	if u.Topic != nil {
+		config.Topic = *u.Topic
+	}
+	if u.Description != nil {
+		config.Description = *u.Description
+	}
+	if u.MaxMembers != nil {
+		config.MaxMembers = *u.MaxMembers
+	}
+	if u.Visibility != nil {
+		config.Visibility = *u.Visibility
+	}
+	if u.NamePolicy != nil {
+		config.NamePolicy = *u.NamePolicy
+	}
+	if u.Moderated != nil {
+		config.Moderated = *u.Moderated
+	}
+	if len(u.Attributes) > 0 {
+		// Copy so readers holding the previous map are not affected
+		attributes := make(map[string]string, len(config.Attributes)+len(u.Attributes))
+		for key, value := range config.Attributes {
+			attributes[key] = value
+		}
+		for key, value := range u.Attributes {
+			if value == nil {
+				delete(attributes, key)
+			} else {
+				attributes[key] = *value
+			}
+		}
+		config.Attributes = attributes
+	}
+	return config
+}
+
+// HistoryData represents a batch of past messages replayed to a client
+type HistoryData struct {
+	Reason    string          `json:"reason"` // "join" or "resume"
+	Messages  []StoredMessage `json:"messages"`
+	Truncated bool            `json:"truncated,omitempty"` // Part of the requested gap is no longer retained
+}
+
+// Policies for members of a deleted or renamed room
+const (
+	roomPolicyMove       = "move"       // Move members to another room (the renamed room on rename)
+	roomPolicyDisconnect = "disconnect" // Disconnect members
+)
+
+var (
+	errRoomNotFound = errors.New("room not found")
+	errRoomExists   = errors.New("room already exists")
+)
+
+// roomChange is a request to delete or rename a room, applied by the hub loop
+type roomChange struct {
+	room    string
+	newName string // New name, empty to delete the room
+	policy  string
+	target  string // Destination room when deleting with the move policy
+	result  chan error
+}
+
+// messageChange is an edit or deletion of a stored chat message requested by
+// a client. It is routed through the broadcast channel so it cannot overtake
+// the message it refers to
+type messageChange struct {
+	ID        string
+	Text      string
+	Delete    bool
+	SessionID string // Session of the requesting client
+	Name      string
+	Moderator bool // The client may change messages of other users
+}
+
+// reactionChange adds or removes the reaction of a user to a stored chat message
+type reactionChange struct {
+	ID       string
+	Reaction string
+	Remove   bool
+	Name     string
+}
+
+// profileChange updates the profile of a connected client
+type profileChange struct {
+	client *Client
+	update ProfileUpdate
+}
+
+// disconnectRequest asks the hub loop to close the connections of matching clients
+type disconnectRequest struct {
+	match  func(*Client) bool
+	code   int
+	reason string
+	result chan int
 }
 
 type Hub struct {
-	mu               sync.RWMutex
-	clients          map[*Client]bool
-	rooms            map[string]map[*Client]bool
-	predefinedRooms  map[string]bool
+	mu                sync.RWMutex
+	clients           map[*Client]bool
+	rooms             map[string]map[*Client]bool
+	predefinedRooms   map[string]*RoomConfig
 	allowDynamicRooms bool
-	broadcast        chan WebSocketMessage
-	register         chan *Client
-	unregister       chan *Client
+	historySize       int
+	namePolicy        string
+	directMessages    bool
+	maxMetadataSize   int
+	messageTypes      map[string]*MessageType // Custom message types by name
+	limiter           *RateLimiter            // Nil when messages are not rate limited
+	moderation        *ModerationStore
+	filters           *FilterChain                 // Nil when no content filters are configured
+	pending           map[string][]*PendingMessage // Messages waiting for review by room
+	webhooks          *WebhookDispatcher           // Nil when room events are not posted to webhooks
+	broadcast         chan WebSocketMessage
+	register          chan *Client
+	unregister        chan *Client
+	roomChanges       chan roomChange
+	disconnects       chan disconnectRequest
+	reviews           chan reviewChange
+	store             MessageStore
 }
 
-func NewHub() *Hub {
+func NewHub(store MessageStore) *Hub {
 	return &Hub{
-		clients:          make(map[*Client]bool),
-		rooms:            make(map[string]map[*Client]bool),
-		predefinedRooms:  make(map[string]bool),
+		clients:           make(map[*Client]bool),
+		rooms:             make(map[string]map[*Client]bool),
+		predefinedRooms:   make(map[string]*RoomConfig),
 		allowDynamicRooms: false,
-		broadcast:        make(chan WebSocketMessage, 1024),
-		register:         make(chan *Client),
-		unregister:       make(chan *Client),
+		namePolicy:        namePolicyAllow,
+		maxMetadataSize:   defaultMetadataSize,
+		moderation:        &ModerationStore{sanctions: make(map[string]*Sanction)},
+		pending:           make(map[string][]*PendingMessage),
+		broadcast:         make(chan WebSocketMessage, 1024),
+		register:          make(chan *Client),
+		unregister:        make(chan *Client),
+		roomChanges:       make(chan roomChange),
+		disconnects:       make(chan disconnectRequest),
+		reviews:           make(chan reviewChange),
+		store:             store,
 	}
 }
 
@@ -43,27 +224,44 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
-			h.clients[client] = true
-			
-			if _, ok := h.rooms[client.room]; !ok {
-				h.rooms[client.room] = make(map[*Client]bool)
+			requested := client.name
+			// serveWS checks bans and the member limit before the upgrade, but
+			// concurrent connections may have filled the room since
+			result := h.admit(client, true)
+			admitted := result.code == 0
+			if admitted {
+				h.clients[client] = true
+				client.joinedAt = time.Now().UTC()
+				
+				if _, ok := h.rooms[client.room]; !ok {
+					h.rooms[client.room] = make(map[*Client]bool)
+				}
+				h.rooms[client.room][client] = true
 			}
-			h.rooms[client.room][client] = true
 			h.mu.Unlock()
+			client.admitted <- admitted
+			
+			if !admitted {
+				log.Printf("[INFO] Client rejected: name=%s, room=%s (%s)", requested, client.room, result.reason)
+				if result.code == closeNameTaken {
+					h.notifyNameConflict(client, requested, result.policy)
+				}
+				client.disconnect(result.code, result.reason)
+				break
+			}
+			if client.name != requested {
+				h.notifyNameConflict(client, requested, result.policy)
+			}
 			
 			log.Printf("[INFO] Client connected: name=%s, room=%s", client.name, client.room)
 			
+			// Replay recent history and the current members before any live traffic
+			h.replayHistory(client)
+			h.sendRoster(client)
+			h.sendPendingQueue(client)
+			
 			// Send join notification to the room
-			joinMsg := WebSocketMessage{
-				Type:      "user_event",
-				Room:      client.room,
-				Timestamp: time.Now().UTC().Format(time.RFC3339),
-				Data: UserEventData{
-					Event: "join",
-					User:  client.name,
-				},
-			}
-			h.broadcast <- joinMsg
+			h.broadcast <- userEvent("join", client)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
@@ -81,15 +279,7 @@ func (h *Hub) run() {
 					} else {
 						// Prepare leave notification
 						shouldSendLeaveMsg = true
-						leaveMsg = WebSocketMessage{
-							Type:      "user_event",
-							Room:      client.room,
-							Timestamp: time.Now().UTC().Format(time.RFC3339),
-							Data: UserEventData{
-								Event: "leave",
-								User:  client.name,
-							},
-						}
+						leaveMsg = userEvent("leave", client)
 					}
 				}
 				
@@ -106,34 +296,595 @@ func (h *Hub) run() {
 
 		case message := <-h.broadcast:
 			h.route(message)
+
+		case change := <-h.roomChanges:
+			if change.newName == "" {
+				change.result <- h.deleteRoom(change)
+			} else {
+				change.result <- h.renameRoom(change)
+			}
+
+		case req := <-h.disconnects:
+			req.result <- h.disconnectMatching(req)
+
+		case change := <-h.reviews:
+			change.result <- h.review(change)
 		}
 	}
 }
 
 func (h *Hub) route(msg WebSocketMessage) {
+	switch data := msg.Data.(type) {
+	case messageChange:
+		h.changeMessage(msg, data)
+		return
+	case reactionChange:
+		h.react(msg, data)
+		return
+	case profileChange:
+		h.updateProfile(msg, data)
+		return
+	case AckData, ErrorData:
+		// Replies are only sent back to the client they are meant for
+		h.reply(msg.origin, msg)
+		return
+	}
+
+	// Messages held by a content filter and messages of moderated rooms wait
+	// for a moderator
+	if !msg.reviewed && msg.holdReason != "" {
+		h.enqueue(msg.Room, msg, msg.holdReason)
+		return
+	}
+	if !msg.reviewed {
+		if room, ok := h.needsReview(msg); ok {
+			h.enqueue(room, msg, moderatedRoomReason)
+			return
+		}
+	}
+
+	// Whispers and direct messages are only delivered to the recipient and
+	// the sender, mentions are broadcast to the room like any other chat message.
+	// Custom message types are delivered and stored as their definition says
+	var recipients []string
+	persist := msg.Type != "typing"
+	chatData, isChat := msg.Data.(ChatData)
+	if isChat && (msg.Type == "whisper" || msg.Type == "dm") {
+		// Private messages to nobody are refused instead of reaching only the sender
+		if !h.isConnected(msg, chatData.To) {
+			log.Printf("[WARN] Dropped %s from %s: %s is not connected", msg.Type, chatData.From, chatData.To)
+			h.rejectMessage(msg, errorNotFound, fmt.Sprintf("user %s is not connected", chatData.To))
+			return
+		}
+		recipients = []string{chatData.To}
+		if chatData.From != chatData.To {
+			recipients = append(recipients, chatData.From)
+		}
+	}
+	if customData, ok := msg.Data.(CustomData); ok {
+		customType, ok := h.MessageType(msg.Type)
+		if !ok {
+			return
+		}
+		recipients = customType.recipients(customData)
+		persist = customType.Persist
+	}
+
+	// Stored messages get their ID and per-room sequence number from the
+	// store, typing indicators are ephemeral
+	if persist {
+		if stored, ok := h.record(msg, recipients); ok {
+			msg.ID = stored.ID
+			msg.Seq = stored.Seq
+		}
+	}
+
 	data, err := json.Marshal(msg)
 	if err != nil {
 		log.Printf("[ERROR] Failed to marshal message: %v", err)
 		return
 	}
 
-	// Handle chat messages with mentions
-	if msg.Type == "chat" {
-		if chatData, ok := msg.Data.(ChatData); ok {
-			if strings.HasPrefix(chatData.Text, "@") {
-				parts := strings.SplitN(chatData.Text, " ", 2)
-				if len(parts) > 0 {
-					targetName := strings.TrimPrefix(parts[0], "@")
-					h.sendToUser(targetName, data)
-					// Also send to the sender
-					h.sendToUser(chatData.From, data)
-					return
-				}
+	if recipients != nil {
+		// The room of the envelope stays the sender's room, direct messages
+		// reach the recipient in whatever room it is in
+		for _, name := range recipients {
+			room := msg.Room
+			if msg.Type == "dm" && name == chatData.To {
+				room = ""
 			}
+			h.sendToUser(room, name, data)
+		}
+	} else {
+		h.sendToRoom(msg.Room, data)
+	}
+	if webhooks := h.Webhooks(); webhooks != nil {
+		webhooks.Dispatch(msg, data)
+	}
+	h.acknowledge(msg)
+}
+
+// changeMessage applies an edit or deletion to a stored chat message and
+// announces it to the room. The announcement acknowledges the request
+func (h *Hub) changeMessage(msg WebSocketMessage, change messageChange) {
+	room := msg.Room
+	if h.store == nil {
+		h.rejectMessage(msg, errorNotFound, "message not found")
+		return
+	}
+
+	stored, ok, err := h.store.Get(room, change.ID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load message %s: %v", change.ID, err)
+		h.rejectMessage(msg, errorInternal, "failed to load message")
+		return
+	}
+	if !ok || stored.Type != "chat" || stored.Deleted {
+		log.Printf("[WARN] Cannot change message %s in room %s: not found", change.ID, room)
+		h.rejectMessage(msg, errorNotFound, "message not found")
+		return
+	}
+	if stored.FromId != change.SessionID && !change.Moderator {
+		log.Printf("[WARN] %s may not change message %s in room %s", change.Name, change.ID, room)
+		h.rejectMessage(msg, errorForbidden, "only the sender or a moderator may change the message")
+		return
+	}
+	// Edits cannot wait for review, so they would bypass it in moderated rooms
+	if !change.Delete && !change.Moderator && h.isModerated(room) {
+		log.Printf("[WARN] %s may not edit message %s in moderated room %s", change.Name, change.ID, room)
+		h.rejectMessage(msg, errorForbidden, "edits are not allowed in moderated rooms")
+		return
+	}
+
+	var chatData ChatData
+	if err := json.Unmarshal(stored.Data, &chatData); err != nil {
+		log.Printf("[ERROR] Failed to decode message %s: %v", change.ID, err)
+		h.rejectMessage(msg, errorInternal, "failed to load message")
+		return
+	}
+
+	event := WebSocketMessage{
+		Room:        room,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		origin:      msg.origin,
+		clientMsgID: msg.clientMsgID,
+	}
+	if change.Delete {
+		// Keep a tombstone without the text
+		chatData.Text = ""
+		chatData.Mention = nil
+		chatData.Metadata = nil
+		chatData.Attachments = nil
+		stored.Deleted = true
+		stored.Reactions = nil
+		event.Type = "chat_deleted"
+		event.Data = ChatDeletedData{ID: stored.ID, Seq: stored.Seq, DeletedBy: change.Name}
+	} else {
+		chatData.Text = change.Text
+		chatData.Mention = parseMentions(change.Text)
+		stored.Revision++
+		stored.EditedAt = event.Timestamp
+		event.Type = "chat_updated"
+		event.Data = ChatUpdatedData{
+			ID:       stored.ID,
+			Seq:      stored.Seq,
+			Revision: stored.Revision,
+			Text:     chatData.Text,
+			Mention:  chatData.Mention,
+			EditedBy: change.Name,
 		}
 	}
 
-	h.sendToRoom(msg.Room, data)
+	stored.Data, err = json.Marshal(chatData)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal message data: %v", err)
+		h.rejectMessage(msg, errorInternal, "failed to update message")
+		return
+	}
+	if err := h.store.Update(stored); err != nil {
+		log.Printf("[ERROR] Failed to update message %s: %v", change.ID, err)
+		h.rejectMessage(msg, errorInternal, "failed to update message")
+		return
+	}
+
+	log.Printf("[INFO] Message %s: id=%s, room=%s, by=%s", event.Type, change.ID, room, change.Name)
+	h.route(event)
+}
+
+// react applies a reaction change to a stored chat message and sends the new
+// totals to the room. Reaction updates are not stored as messages of their own
+func (h *Hub) react(msg WebSocketMessage, change reactionChange) {
+	room := msg.Room
+	if h.store == nil {
+		h.rejectMessage(msg, errorNotFound, "message not found")
+		return
+	}
+
+	stored, ok, err := h.store.Get(room, change.ID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load message %s: %v", change.ID, err)
+		h.rejectMessage(msg, errorInternal, "failed to load message")
+		return
+	}
+	if !ok || stored.Type != "chat" || stored.Deleted {
+		log.Printf("[WARN] Cannot react to message %s in room %s: not found", change.ID, room)
+		h.rejectMessage(msg, errorNotFound, "message not found")
+		return
+	}
+
+	users := stored.Reactions[change.Reaction]
+	index := slices.Index(users, change.Name)
+	if change.Remove == (index < 0) {
+		// Adding a reaction twice or removing a missing one changes nothing
+		h.acknowledge(msg)
+		return
+	}
+
+	reactions := make(map[string][]string, len(stored.Reactions)+1)
+	for reaction, users := range stored.Reactions {
+		reactions[reaction] = users
+	}
+	if change.Remove {
+		users = slices.Delete(slices.Clone(users), index, index+1)
+		if len(users) == 0 {
+			delete(reactions, change.Reaction)
+		} else {
+			reactions[change.Reaction] = users
+		}
+	} else {
+		if users == nil && len(reactions) >= maxMessageReactions {
+			log.Printf("[WARN] Message %s in room %s has too many reactions", change.ID, room)
+			h.rejectMessage(msg, errorInvalidMessage, "too many reactions")
+			return
+		}
+		reactions[change.Reaction] = append(slices.Clone(users), change.Name)
+	}
+	stored.Reactions = reactions
+
+	if err := h.store.Update(stored); err != nil {
+		log.Printf("[ERROR] Failed to update message %s: %v", change.ID, err)
+		h.rejectMessage(msg, errorInternal, "failed to update message")
+		return
+	}
+
+	counts := make(map[string]int, len(reactions))
+	for reaction, users := range reactions {
+		counts[reaction] = len(users)
+	}
+	data, err := json.Marshal(WebSocketMessage{
+		Type:      "reaction_update",
+		Room:      room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data: ReactionUpdateData{
+			ID:        stored.ID,
+			Seq:       stored.Seq,
+			User:      change.Name,
+			Reaction:  change.Reaction,
+			Removed:   change.Remove,
+			Reactions: counts,
+		},
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal reaction update: %v", err)
+		return
+	}
+	h.sendToRoom(room, data)
+	h.acknowledge(msg)
+}
+
+// updateProfile applies a profile change and announces it to the client's room
+func (h *Hub) updateProfile(msg WebSocketMessage, change profileChange) {
+	h.mu.Lock()
+	if _, ok := h.clients[change.client]; !ok {
+		h.mu.Unlock()
+		return
+	}
+	change.client.profile = change.update.apply(change.client.profile)
+	event := userEvent("profile_updated", change.client)
+	event.origin = msg.origin
+	event.clientMsgID = msg.clientMsgID
+	h.mu.Unlock()
+
+	log.Printf("[INFO] Profile updated: name=%s, room=%s", change.client.name, event.Room)
+	h.route(event)
+}
+
+// record appends a routed message to the message store
+func (h *Hub) record(msg WebSocketMessage, recipients []string) (StoredMessage, bool) {
+	if h.store == nil {
+		return StoredMessage{}, false
+	}
+
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal message data: %v", err)
+		return StoredMessage{}, false
+	}
+
+	stored := StoredMessage{
+		ID:        generateMessageID(),
+		Type:      msg.Type,
+		Room:      msg.Room,
+		Timestamp: msg.Timestamp,
+		To:        recipients,
+		Data:      data,
+	}
+	switch data := msg.Data.(type) {
+	case ChatData:
+		stored.From = data.From
+		stored.FromId = data.FromId
+	case CustomData:
+		stored.From = data.From
+		stored.FromId = data.FromId
+	}
+
+	stored, err = h.store.Append(stored)
+	if err != nil {
+		log.Printf("[ERROR] Failed to store message: %v", err)
+		return StoredMessage{}, false
+	}
+	return stored, true
+}
+
+// admission is the outcome of admitting a client to its room
+type admission struct {
+	policy string // Name policy of the room
+	code   int    // Close code when the client was refused, 0 when it was admitted
+	reason string
+}
+
+// admit checks whether a client may be in its room, renaming it if the name
+// policy asks for it and rename is set. Caller must hold the lock
+func (h *Hub) admit(client *Client, rename bool) admission {
+	if !client.principal.CanJoin(client.room) {
+		return admission{code: closeRoomClosed, reason: "room not allowed"}
+	}
+	if _, banned := h.moderation.Banned(client.room, client.name, client.principal, client.ip); banned {
+		return admission{code: closeBanned, reason: "banned"}
+	}
+	if !h.hasCapacity(client.room) {
+		return admission{code: closeRoomFull, reason: "room is full"}
+	}
+	policy, ok := h.resolveName(client, rename)
+	if !ok {
+		return admission{policy: policy, code: closeNameTaken, reason: "name already in use"}
+	}
+	return admission{policy: policy}
+}
+
+// resolveName applies the name policy of the client's room, renaming the client
+// if needed and allowed, and reports whether it may join. Caller must hold the lock
+func (h *Hub) resolveName(client *Client, rename bool) (string, bool) {
+	policy := h.namePolicy
+	if config, ok := h.predefinedRooms[client.room]; ok && config.NamePolicy != "" {
+		policy = config.NamePolicy
+	}
+
+	others := h.membersNamed(client.room, client.name)
+	if len(others) == 0 {
+		return policy, true
+	}
+
+	switch policy {
+	case namePolicyReject:
+		return policy, false
+	case namePolicyPrincipal:
+		for _, other := range others {
+			if !client.principal.sameIdentity(other.principal) {
+				return policy, false
+			}
+		}
+	case namePolicySuffix:
+		if !rename {
+			return policy, false
+		}
+		for n := 2; ; n++ {
+			candidate := fmt.Sprintf("%s#%d", client.name, n)
+			if len(h.membersNamed(client.room, candidate)) == 0 {
+				client.name = candidate
+				break
+			}
+		}
+	}
+	return policy, true
+}
+
+// membersNamed returns the clients of a room using name, caller must hold the lock
+func (h *Hub) membersNamed(room, name string) []*Client {
+	var members []*Client
+	for client := range h.rooms[room] {
+		if client.name == name {
+			members = append(members, client)
+		}
+	}
+	return members
+}
+
+// isConnected reports whether the recipient of a whisper is in the room of
+// the message, or the recipient of a direct message in any room
+func (h *Hub) isConnected(msg WebSocketMessage, name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	clients := h.rooms[msg.Room]
+	if msg.Type == "dm" {
+		clients = h.clients
+	}
+	for client := range clients {
+		if client.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findSession returns the connected client with a session ID, in room unless
+// room is empty
+func (h *Hub) findSession(id, room string) (*Client, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients {
+		if client.id == id && (room == "" || client.room == room) {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+// activeRooms returns the names of the rooms that have members
+func (h *Hub) activeRooms() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rooms := make([]string, 0, len(h.rooms))
+	for name := range h.rooms {
+		rooms = append(rooms, name)
+	}
+	return rooms
+}
+
+// notifyNameConflict tells a client that the name it asked for is already in use
+func (h *Hub) notifyNameConflict(client *Client, requested, policy string) {
+	details := map[string]interface{}{"requested": requested, "policy": policy}
+	if client.name != requested {
+		details["name"] = client.name
+	}
+	data, err := json.Marshal(WebSocketMessage{
+		Type:      "system",
+		Room:      client.room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      SystemEventData{Event: "name_conflict", Details: details},
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal name conflict: %v", err)
+		return
+	}
+
+	select {
+	case client.send <- data:
+	default:
+		log.Printf("[WARN] Send buffer full, dropping name conflict for client %s", client.name)
+	}
+}
+
+// replayHistory sends the recent messages of the client's room as a single history message
+func (h *Hub) replayHistory(client *Client) {
+	if h.store == nil {
+		return
+	}
+
+	history := HistoryData{Reason: "join"}
+	var stored []StoredMessage
+	var err error
+	resume := client.resume
+	if resume {
+		// Sequence numbers start over when the history of the room is lost, such
+		// as after a restart with the memory backend or when the room was
+		// deleted and created again. The client may have missed anything
+		latest, err := h.store.Recent(client.room, 1)
+		if err == nil && client.since > 0 && (len(latest) == 0 || latest[0].Seq < client.since) {
+			log.Printf("[INFO] Cannot resume room %s from seq %d for %s, replaying recent history", client.room, client.since, client.name)
+			resume = false
+			history.Truncated = true
+		}
+	}
+	if resume {
+		// Replay everything after the last sequence number the client saw.
+		// Private messages of others are filtered below, after the gap check,
+		// so they do not look like lost messages
+		history.Reason = "resume"
+		stored, _, err = h.store.Query(MessageQuery{Room: client.room, After: client.since, Limit: math.MaxInt, Private: true})
+		if err == nil && len(stored) > 0 && stored[0].Seq > client.since+1 {
+			history.Truncated = true
+		}
+	} else {
+		n := client.historySize
+		if n < 0 {
+			n = h.roomHistorySize(client.room)
+		}
+		if n == 0 && !history.Truncated {
+			return
+		}
+		stored, err = h.store.Recent(client.room, n)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to load history for room %s: %v", client.room, err)
+		return
+	}
+
+	// Skip private messages the client was not part of
+	history.Messages = make([]StoredMessage, 0, len(stored))
+	for _, msg := range stored {
+		if msg.visibleTo(client.name) {
+			history.Messages = append(history.Messages, msg)
+		}
+	}
+
+	data, err := json.Marshal(WebSocketMessage{
+		Type:      "history",
+		Room:      client.room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      history,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal history: %v", err)
+		return
+	}
+
+	select {
+	case client.send <- data:
+	default:
+		log.Printf("[WARN] Send buffer full, dropping history for client %s", client.name)
+	}
+}
+
+// sendRoster sends the current members of the client's room to the client
+func (h *Hub) sendRoster(client *Client) {
+	members, _ := h.GetMembers(client.room)
+	data, err := json.Marshal(WebSocketMessage{
+		Type:      "roster",
+		Room:      client.room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      RosterData{Members: members},
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal roster: %v", err)
+		return
+	}
+
+	select {
+	case client.send <- data:
+	default:
+		log.Printf("[WARN] Send buffer full, dropping roster for client %s", client.name)
+	}
+}
+
+// userEvent builds a join or leave event for a client in its current room,
+// must be called from the hub loop or with the hub lock held
+func userEvent(event string, client *Client) WebSocketMessage {
+	member := client.memberInfo()
+	return WebSocketMessage{
+		Type:      "user_event",
+		Room:      client.room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data: UserEventData{
+			Event:  event,
+			User:   client.name,
+			Member: &member,
+		},
+	}
+}
+
+// roomHistorySize returns the number of messages replayed on join for a room
+func (h *Hub) roomHistorySize(room string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if config, ok := h.predefinedRooms[room]; ok && config.HistorySize != nil {
+		return *config.HistorySize
+	}
+	return h.historySize
 }
 
 func (h *Hub) sendToRoom(room string, data []byte) {
@@ -173,11 +924,17 @@ func (h *Hub) sendToRoom(room string, data []byte) {
 	}
 }
 
-func (h *Hub) sendToUser(name string, data []byte) {
+// sendToUser sends to every client using name in a room, or in any room
+// when room is empty
+func (h *Hub) sendToUser(room, name string, data []byte) {
 	h.mu.RLock()
+	clients := h.rooms[room]
+	if room == "" {
+		clients = h.clients
+	}
 	// Find all clients with this name
 	targetClients := make([]*Client, 0)
-	for client := range h.clients {
+	for client := range clients {
 		if client.name == name {
 			targetClients = append(targetClients, client)
 		}
@@ -190,7 +947,7 @@ func (h *Hub) sendToUser(name string, data []byte) {
 			// Message sent successfully
 		case <-time.After(5 * time.Second):
 			// Timeout - client is not responsive
-			log.Printf("[WARN] Message send timeout for client %s (direct message), removing client", client.name)
+			log.Printf("[WARN] Message send timeout for client %s (private message), removing client", client.name)
 			h.removeClient(client)
 		}
 	}
@@ -214,20 +971,379 @@ func (h *Hub) removeClient(client *Client) {
 	}
 }
 
+// GetMessages returns a page of the stored history of a room
+func (h *Hub) GetMessages(q MessageQuery) ([]StoredMessage, bool, error) {
+	if h.store == nil {
+		return []StoredMessage{}, false, nil
+	}
+	return h.store.Query(q)
+}
+
 // CreateRoom creates a new predefined room
-func (h *Hub) CreateRoom(name string) error {
+func (h *Hub) CreateRoom(name string, config RoomConfig) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	
 	if _, exists := h.predefinedRooms[name]; exists {
-		return fmt.Errorf("room already exists: %s", name)
+		return fmt.Errorf("%w: %s", errRoomExists, name)
 	}
 	
-	h.predefinedRooms[name] = true
+	h.predefinedRooms[name] = &config
 	log.Printf("[INFO] Room created: %s", name)
 	return nil
 }
 
+// UpdateRoom changes the settings of a predefined room and notifies its members
+func (h *Hub) UpdateRoom(name string, update RoomUpdate) error {
+	h.mu.Lock()
+	updated, err := h.updatedConfig(name, update)
+	if err != nil {
+		h.mu.Unlock()
+		return err
+	}
+	h.predefinedRooms[name] = &updated
+	info := RoomInfo{Name: name, UserCount: len(h.rooms[name]), RoomConfig: updated}
+	h.mu.Unlock()
+
+	log.Printf("[INFO] Room updated: %s", name)
+
+	// Announce the new settings to the members
+	details := make(map[string]interface{})
+	if data, err := json.Marshal(info); err == nil {
+		json.Unmarshal(data, &details)
+	}
+	h.broadcast <- WebSocketMessage{
+		Type:      "system",
+		Room:      name,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      SystemEventData{Event: "room_updated", Details: details},
+	}
+	return nil
+}
+
+// CheckRoomUpdate reports whether UpdateRoom would accept an update of a
+// room, so a request that also renames the room can fail before the rename
+func (h *Hub) CheckRoomUpdate(name string, update RoomUpdate) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, err := h.updatedConfig(name, update)
+	return err
+}
+
+// updatedConfig returns the settings of a room with an update applied,
+// caller must hold the lock
+func (h *Hub) updatedConfig(name string, update RoomUpdate) (RoomConfig, error) {
+	config, ok := h.predefinedRooms[name]
+	if !ok {
+		return RoomConfig{}, fmt.Errorf("%w: %s", errRoomNotFound, name)
+	}
+	updated := update.apply(*config)
+	if len(updated.Attributes) > maxRoomAttributes {
+		return RoomConfig{}, fmt.Errorf("at most %d attributes are allowed", maxRoomAttributes)
+	}
+	return updated, nil
+}
+
+// HasCapacity reports whether another client may join a room
+func (h *Hub) HasCapacity(name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.hasCapacity(name)
+}
+
+// hasCapacity reports whether another client may join a room, caller must hold the lock
+func (h *Hub) hasCapacity(name string) bool {
+	config, ok := h.predefinedRooms[name]
+	if !ok || config.MaxMembers == 0 {
+		return true
+	}
+	return len(h.rooms[name]) < config.MaxMembers
+}
+
+// DeleteRoom deletes a room, moving or disconnecting its members according to policy
+func (h *Hub) DeleteRoom(name, policy, target string) error {
+	result := make(chan error, 1)
+	h.roomChanges <- roomChange{room: name, policy: policy, target: target, result: result}
+	return <-result
+}
+
+// RenameRoom renames a room, moving or disconnecting its members according to policy
+func (h *Hub) RenameRoom(name, newName, policy string) error {
+	result := make(chan error, 1)
+	h.roomChanges <- roomChange{room: name, newName: newName, policy: policy, result: result}
+	return <-result
+}
+
+// deleteRoom applies a room deletion, must be called from the hub loop
+func (h *Hub) deleteRoom(change roomChange) error {
+	h.mu.RLock()
+	_, isPredefined := h.predefinedRooms[change.room]
+	_, isActive := h.rooms[change.room]
+	h.mu.RUnlock()
+
+	if !isPredefined && !isActive {
+		return fmt.Errorf("%w: %s", errRoomNotFound, change.room)
+	}
+	if change.policy == roomPolicyMove {
+		if change.target == change.room || !h.IsRoomAllowed(change.target) {
+			return fmt.Errorf("invalid target room: %s", change.target)
+		}
+	}
+
+	// Tell the members before moving or disconnecting them
+	details := map[string]interface{}{"policy": change.policy}
+	if change.policy == roomPolicyMove {
+		details["target"] = change.target
+	}
+	if data, err := json.Marshal(WebSocketMessage{
+		Type:      "system",
+		Room:      change.room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      SystemEventData{Event: "room_deleted", Details: details},
+	}); err == nil {
+		h.sendToRoom(change.room, data)
+	}
+
+	if change.policy == roomPolicyMove {
+		h.moveMembers(change.room, change.target)
+	} else {
+		h.disconnectMembers(change.room, "room deleted")
+	}
+
+	h.mu.Lock()
+	delete(h.predefinedRooms, change.room)
+	delete(h.pending, change.room)
+	h.mu.Unlock()
+
+	if h.store != nil {
+		if err := h.store.DeleteRoom(change.room); err != nil {
+			log.Printf("[ERROR] Failed to delete history of room %s: %v", change.room, err)
+		}
+	}
+
+	log.Printf("[INFO] Room deleted: %s (policy=%s)", change.room, change.policy)
+	return nil
+}
+
+// renameRoom applies a room rename, must be called from the hub loop
+func (h *Hub) renameRoom(change roomChange) error {
+	h.mu.Lock()
+	config, isPredefined := h.predefinedRooms[change.room]
+	members, isActive := h.rooms[change.room]
+	if !isPredefined && !isActive {
+		h.mu.Unlock()
+		return fmt.Errorf("%w: %s", errRoomNotFound, change.room)
+	}
+	_, newPredefined := h.predefinedRooms[change.newName]
+	_, newActive := h.rooms[change.newName]
+	if newPredefined || newActive {
+		h.mu.Unlock()
+		return fmt.Errorf("%w: %s", errRoomExists, change.newName)
+	}
+	h.mu.Unlock()
+
+	details := map[string]interface{}{"from": change.room, "to": change.newName, "policy": change.policy}
+	if change.policy == roomPolicyDisconnect {
+		if data, err := json.Marshal(WebSocketMessage{
+			Type:      "system",
+			Room:      change.room,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Data:      SystemEventData{Event: "room_renamed", Details: details},
+		}); err == nil {
+			h.sendToRoom(change.room, data)
+		}
+		h.disconnectMembers(change.room, "room renamed")
+		isActive = false
+	}
+
+	h.mu.Lock()
+	if isPredefined {
+		h.predefinedRooms[change.newName] = config
+		delete(h.predefinedRooms, change.room)
+	}
+	var leaveMsgs []WebSocketMessage
+	if isActive {
+		// Members follow the room to its new name, those whose JWT does not
+		// allow the new name are disconnected
+		delete(h.rooms, change.room)
+		for client := range members {
+			client.room = change.newName
+			if !client.principal.CanJoin(change.newName) {
+				delete(members, client)
+				delete(h.clients, client)
+				client.disconnect(closeRoomClosed, "room not allowed")
+				log.Printf("[INFO] Client disconnected: name=%s, room=%s (room not allowed)", client.name, change.room)
+				leaveMsgs = append(leaveMsgs, userEvent("leave", client))
+			}
+		}
+		if len(members) > 0 {
+			h.rooms[change.newName] = members
+		} else {
+			isActive = false
+		}
+	}
+	if queue, ok := h.pending[change.room]; ok {
+		// Pending messages are delivered to the room under its new name
+		for _, pending := range queue {
+			pending.Message.Room = change.newName
+		}
+		h.pending[change.newName] = queue
+		delete(h.pending, change.room)
+	}
+	moderation := h.moderation
+	h.mu.Unlock()
+
+	// Bans and mutes of the room follow it, or a rename would lift them
+	if err := moderation.RenameRoom(change.room, change.newName); err != nil {
+		log.Printf("[ERROR] Failed to rename sanctions of room %s: %v", change.room, err)
+	}
+
+	if h.store != nil {
+		if err := h.store.RenameRoom(change.room, change.newName); err != nil {
+			log.Printf("[ERROR] Failed to rename history of room %s: %v", change.room, err)
+		}
+	}
+
+	if isActive {
+		h.route(WebSocketMessage{
+			Type:      "system",
+			Room:      change.newName,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Data:      SystemEventData{Event: "room_renamed", Details: details},
+		})
+		for _, msg := range leaveMsgs {
+			h.route(msg)
+		}
+	}
+
+	log.Printf("[INFO] Room renamed: %s -> %s (policy=%s)", change.room, change.newName, change.policy)
+	return nil
+}
+
+// moveMembers moves every client of a room into another room
+func (h *Hub) moveMembers(from, to string) {
+	h.mu.Lock()
+	members := make([]*Client, 0, len(h.rooms[from]))
+	for client := range h.rooms[from] {
+		members = append(members, client)
+	}
+	delete(h.rooms, from)
+	// The longest-standing members get the places when the target room fills up
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].joinedAt.Before(members[j].joinedAt)
+	})
+
+	// Members are admitted like new connections, those refused are disconnected
+	moved := make([]*Client, 0, len(members))
+	for _, client := range members {
+		requested := client.name
+		client.room = to
+		// The sequence number a client resumed from belongs to the old room
+		client.resume = false
+		client.since = 0
+		// The read loop of a connected client reads its name without the
+		// lock, so members are not renamed but disconnected on a conflict
+		result := h.admit(client, false)
+		if result.code != 0 {
+			log.Printf("[INFO] Client not moved: name=%s, room=%s -> %s (%s)", requested, from, to, result.reason)
+			if result.code == closeNameTaken {
+				h.notifyNameConflict(client, requested, result.policy)
+			}
+			delete(h.clients, client)
+			client.disconnect(result.code, result.reason)
+			continue
+		}
+		if _, ok := h.rooms[to]; !ok {
+			h.rooms[to] = make(map[*Client]bool)
+		}
+		client.joinedAt = time.Now().UTC()
+		h.rooms[to][client] = true
+		moved = append(moved, client)
+	}
+	h.mu.Unlock()
+
+	for _, client := range moved {
+		log.Printf("[INFO] Client moved: name=%s, room=%s -> %s", client.name, from, to)
+		h.replayHistory(client)
+		h.sendRoster(client)
+		h.sendPendingQueue(client)
+		h.route(userEvent("join", client))
+	}
+}
+
+// Disconnect closes the connections of every client matching match and
+// returns how many were closed
+func (h *Hub) Disconnect(match func(*Client) bool, code int, reason string) int {
+	result := make(chan int, 1)
+	h.disconnects <- disconnectRequest{match: match, code: code, reason: reason, result: result}
+	return <-result
+}
+
+// disconnectMatching applies a disconnect request, must be called from the hub loop
+func (h *Hub) disconnectMatching(req disconnectRequest) int {
+	h.mu.Lock()
+	var leaveMsgs []WebSocketMessage
+	count := 0
+	for client := range h.clients {
+		if !req.match(client) {
+			continue
+		}
+		count++
+		delete(h.clients, client)
+		client.disconnect(req.code, req.reason)
+		if room, ok := h.rooms[client.room]; ok {
+			delete(room, client)
+			if len(room) == 0 {
+				delete(h.rooms, client.room)
+			} else {
+				leaveMsgs = append(leaveMsgs, userEvent("leave", client))
+			}
+		}
+		log.Printf("[INFO] Client disconnected: name=%s, room=%s (%s)", client.name, client.room, req.reason)
+	}
+	h.mu.Unlock()
+
+	for _, msg := range leaveMsgs {
+		h.route(msg)
+	}
+	return count
+}
+
+// disconnectMembers closes the connections of every client in a room
+func (h *Hub) disconnectMembers(room, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.rooms[room] {
+		delete(h.clients, client)
+		client.disconnect(closeRoomClosed, reason)
+		log.Printf("[INFO] Client disconnected: name=%s, room=%s (%s)", client.name, room, reason)
+	}
+	delete(h.rooms, room)
+}
+
+// GetMembers returns the clients in a room ordered by join time, and whether
+// the room has any
+func (h *Hub) GetMembers(room string) ([]MemberInfo, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	clients, ok := h.rooms[room]
+	ordered := make([]*Client, 0, len(clients))
+	for client := range clients {
+		ordered = append(ordered, client)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].joinedAt.Before(ordered[j].joinedAt)
+	})
+
+	members := make([]MemberInfo, 0, len(ordered))
+	for _, client := range ordered {
+		members = append(members, client.memberInfo())
+	}
+	return members, ok
+}
+
 // GetRooms returns a list of all rooms with their user counts
 func (h *Hub) GetRooms() []RoomInfo {
 	h.mu.RLock()
@@ -236,10 +1352,14 @@ func (h *Hub) GetRooms() []RoomInfo {
 	var rooms []RoomInfo
 	
 	// Add predefined rooms
-	for roomName := range h.predefinedRooms {
+	for roomName, config := range h.predefinedRooms {
+		if config.Visibility == roomVisibilityUnlisted {
+			continue
+		}
 		info := RoomInfo{
-			Name:      roomName,
-			UserCount: 0,
+			Name:       roomName,
+			UserCount:  0,
+			RoomConfig: *config,
 		}
 		if activeRoom, exists := h.rooms[roomName]; exists {
 			info.UserCount = len(activeRoom)
@@ -284,6 +1404,119 @@ func (h *Hub) SetAllowDynamicRooms(allow bool) {
 	h.allowDynamicRooms = allow
 }
 
+// SetNamePolicy sets the name policy of rooms without their own policy
+func (h *Hub) SetNamePolicy(policy string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.namePolicy = policy
+}
+
+// SetDirectMessages enables or disables cross-room direct messages
+func (h *Hub) SetDirectMessages(allow bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.directMessages = allow
+}
+
+// DirectMessagesAllowed reports whether cross-room direct messages are enabled
+func (h *Hub) DirectMessagesAllowed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.directMessages
+}
+
+// SetRateLimiter sets the rate limits applied to client messages
+func (h *Hub) SetRateLimiter(limiter *RateLimiter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.limiter = limiter
+}
+
+// RateLimiter returns the rate limiter, nil when messages are not limited
+func (h *Hub) RateLimiter() *RateLimiter {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.limiter
+}
+
+// SetModeration sets the store of bans and mutes
+func (h *Hub) SetModeration(store *ModerationStore) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.moderation = store
+}
+
+// Moderation returns the store of bans and mutes
+func (h *Hub) Moderation() *ModerationStore {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.moderation
+}
+
+// SetFilters sets the content filters applied to message text
+func (h *Hub) SetFilters(filters *FilterChain) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.filters = filters
+}
+
+// Filters returns the content filters, nil when text is not filtered
+func (h *Hub) Filters() *FilterChain {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.filters
+}
+
+// SetMessageTypes sets the custom message types clients may send
+func (h *Hub) SetMessageTypes(types map[string]*MessageType) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messageTypes = types
+}
+
+// MessageType returns the custom message type with the given name
+func (h *Hub) MessageType(name string) (*MessageType, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	messageType, ok := h.messageTypes[name]
+	return messageType, ok
+}
+
+// SetMaxMetadataSize sets the maximum size of chat message metadata in bytes
+func (h *Hub) SetMaxMetadataSize(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxMetadataSize = n
+}
+
+// MaxMetadataSize returns the maximum size of chat message metadata in bytes
+func (h *Hub) MaxMetadataSize() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.maxMetadataSize
+}
+
+// SetWebhooks sets the dispatcher that posts room events to webhooks
+func (h *Hub) SetWebhooks(webhooks *WebhookDispatcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.webhooks = webhooks
+}
+
+// Webhooks returns the webhook dispatcher, nil when webhooks are disabled
+func (h *Hub) Webhooks() *WebhookDispatcher {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.webhooks
+}
+
+// SetHistorySize sets the default number of messages replayed on join
+func (h *Hub) SetHistorySize(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.historySize = n
+}
+
 // shutdown gracefully shuts down the hub
 func (h *Hub) shutdown() {
 	h.mu.Lock()
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestReplayHistoryResume(t *testing.T) {
+	tests := []struct {
+		name      string
+		stored    int
+		since     uint64
+		reason    string
+		seqs      []uint64
+		truncated bool
+	}{
+		{"missed messages", 5, 3, "resume", []uint64{4, 5}, false},
+		{"up to date", 5, 5, "resume", []uint64{}, false},
+		{"gap no longer retained", 12, 1, "resume", []uint64{3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, true},
+		{"since beyond newest seq", 3, 7, "join", []uint64{2, 3}, true},
+		{"since in an empty room", 0, 7, "join", []uint64{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub(NewMemoryStore(10))
+			hub.historySize = 2
+			for i := 0; i < tt.stored; i++ {
+				hub.store.Append(StoredMessage{ID: generateID("msg"), Type: "chat", Room: "lobby"})
+			}
+			client := &Client{
+				hub:         hub,
+				send:        make(chan []byte, 1),
+				room:        "lobby",
+				name:        "alice",
+				principal:   anonymousPrincipal,
+				historySize: -1,
+				resume:      true,
+				since:       tt.since,
+			}
+
+			hub.replayHistory(client)
+
+			var msg struct {
+				Type string      `json:"type"`
+				Data HistoryData `json:"data"`
+			}
+			select {
+			case data := <-client.send:
+				if err := json.Unmarshal(data, &msg); err != nil {
+					t.Fatalf("invalid history message: %v", err)
+				}
+			default:
+				t.Fatal("no history message sent")
+			}
+			if msg.Data.Reason != tt.reason || msg.Data.Truncated != tt.truncated {
+				t.Errorf("reason = %q, truncated = %v, want %q, %v", msg.Data.Reason, msg.Data.Truncated, tt.reason, tt.truncated)
+			}
+			seqs := make([]uint64, 0, len(msg.Data.Messages))
+			for _, stored := range msg.Data.Messages {
+				seqs = append(seqs, stored.Seq)
+			}
+			if !slices.Equal(seqs, tt.seqs) {
+				t.Errorf("seqs = %v, want %v", seqs, tt.seqs)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+var errInvalidJWT = errors.New("invalid JWT")
+
+// JWTClaims are the claims read from an identity token
+type JWTClaims struct {
+	Subject   string          `json:"sub"`
+	Name      string          `json:"name"`  // Chat name, defaults to sub
+	Rooms     []string        `json:"rooms"` // Allowed rooms, "*" or empty allows all
+	Roles     []string        `json:"roles"`
+	Scope     string          `json:"scope"` // Space separated scopes, defaults to read and write
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // A string or an array of strings
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+// hasAudience reports whether the aud claim contains audience
+func (c *JWTClaims) hasAudience(audience string) bool {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(c.Audience, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtKey is a public key used to verify RS256 or EdDSA signatures
+type jwtKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// JWTVerifier verifies signed identity tokens
+type JWTVerifier struct {
+	secret   []byte
+	keys     []jwtKey
+	issuer   string
+	audience string
+}
+
+// NewJWTVerifier creates a verifier for HS256 tokens signed with secret and
+// RS256/EdDSA tokens signed by a key in the file at keyPath (JWKS or PEM)
+func NewJWTVerifier(secret, keyPath, issuer, audience string) (*JWTVerifier, error) {
+	v := &JWTVerifier{secret: []byte(secret), issuer: issuer, audience: audience}
+	if keyPath != "" {
+		keys, err := loadJWTKeys(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+	}
+	if len(v.secret) == 0 && len(v.keys) == 0 {
+		return nil, errors.New("a JWT secret or public key set is required")
+	}
+	return v, nil
+}
+
+// looksLikeJWT reports whether a bearer credential has the JWT compact form
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the signature and validity of a token and returns its claims
+func (v *JWTVerifier) Verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJWT
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !v.verifySignature(header.Alg, header.Kid, signed, signature) {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidJWT)
+	}
+
+	var claims JWTClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: exp claim is required", errInvalidJWT)
+	}
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("%w: token expired", errInvalidJWT)
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("%w: token not yet valid", errInvalidJWT)
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", errInvalidJWT)
+	}
+	if v.audience != "" && !claims.hasAudience(v.audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", errInvalidJWT)
+	}
+	if claims.Subject == "" && claims.Name == "" {
+		return nil, fmt.Errorf("%w: sub or name claim is required", errInvalidJWT)
+	}
+	return &claims, nil
+}
+
+// verifySignature checks a signature with the keys allowed for alg
+func (v *JWTVerifier) verifySignature(alg, kid string, signed, signature []byte) bool {
+	switch alg {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return false
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+
+	case "RS256", "EdDSA":
+		digest := sha256.Sum256(signed)
+		for _, k := range v.keys {
+			if kid != "" && k.id != "" && k.id != kid {
+				continue
+			}
+			switch key := k.key.(type) {
+			case *rsa.PublicKey:
+				if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+					return true
+				}
+			case ed25519.PublicKey:
+				if alg == "EdDSA" && ed25519.Verify(key, signed, signature) {
+					return true
+				}
+			}
+		}
+	}
+	// Any other algorithm, including "none", is rejected
+	return false
+}
+
+// decodeJWTPart decodes a base64url encoded JSON segment of a token
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errInvalidJWT
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidJWT
+	}
+	return nil
+}
+
+// loadJWTKeys reads public keys from a JWKS document or PEM file
+func loadJWTKeys(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT key file: %w", err)
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		return parseJWKS(data)
+	}
+
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWT public key: %w", err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, jwtKey{key: key})
+		default:
+			return nil, fmt.Errorf("unsupported JWT public key type %T", key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys found in JWT key file")
+	}
+	return keys, nil
+}
+
+// parseJWKS parses the RSA and Ed25519 keys of a JSON Web Key Set
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) == 0 {
+				return nil, fmt.Errorf("invalid RSA key in JWKS: %s", k.Kid)
+			}
+			keys = append(keys, jwtKey{id: k.Kid, key: &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}})
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid Ed25519 key in JWKS: %s", k.Kid)
+			}
+			keys = append(keys, jwtKey{id: k.Kid, key: ed25519.PublicKey(x)})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no supported keys found in JWKS")
+	}
+	return keys, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testJWT builds a compact token from a header and claims, signed by sign
+func testJWT(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func TestJWTVerifierVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	eddsa := func(signed []byte) []byte {
+		return ed25519.Sign(edPrivate, signed)
+	}
+	unsigned := func([]byte) []byte { return nil }
+
+	secret := []byte("test-secret")
+	hmacOnly := &JWTVerifier{secret: secret}
+	keysOnly := &JWTVerifier{keys: []jwtKey{{id: "rsa-1", key: &rsaKey.PublicKey}, {id: "ed-1", key: edPublic}}}
+	scoped := &JWTVerifier{secret: secret, issuer: "https://issuer.example", audience: "bushitsu"}
+
+	now := time.Now().Unix()
+	valid := func(extra map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"sub": "alice", "exp": now + 600}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name     string
+		verifier *JWTVerifier
+		header   map[string]interface{}
+		claims   map[string]interface{}
+		sign     func([]byte) []byte
+		wantErr  bool
+	}{
+		{"HS256", hmacOnly, map[string]interface{}{"alg": "HS256"}, valid(nil), hs256(secret), false},
+		{"HS256 wrong secret", hmacOnly, map[string]interface{}{"alg": "HS256"}, valid(nil), hs256([]byte("other")), true},
+		{"RS256", keysOnly, map[string]interface{}{"alg": "RS256"}, valid(nil), rs256, false},
+		{"RS256 matching kid", keysOnly, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, valid(nil), rs256, false},
+		{"RS256 other kid", keysOnly, map[string]interface{}{"alg": "RS256", "kid": "ed-1"}, valid(nil), rs256, true},
+		{"EdDSA", keysOnly, map[string]interface{}{"alg": "EdDSA"}, valid(nil), eddsa, false},
+		{"EdDSA signature as RS256", keysOnly, map[string]interface{}{"alg": "RS256"}, valid(nil), eddsa, true},
+		{"HS256 signed with the RSA public key", keysOnly, map[string]interface{}{"alg": "HS256"}, valid(nil), hs256(rsaPublicDER), true},
+		{"RS256 without keys", hmacOnly, map[string]interface{}{"alg": "RS256"}, valid(nil), rs256, true},
+		{"alg none", hmacOnly, map[string]interface{}{"alg": "none"}, valid(nil), unsigned, true},
+		{"alg missing", hmacOnly, map[string]interface{}{}, valid(nil), hs256(secret), true},
+		{"expired", hmacOnly, map[string]interface{}{"alg": "HS256"}, valid(map[string]interface{}{"exp": now - 120}), hs256(secret), true},
+		{"expired within leeway", hmacOnly, map[string]interface{}{"alg": "HS256"}, valid(map[string]interface{}{"exp": now - 10}), hs256(secret), false},
+		{"exp missing", hmacOnly, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": "alice"}, hs256(secret), true},
+		{"not yet valid", hmacOnly, map[string]interface{}{"alg": "HS256"}, valid(map[string]interface{}{"nbf": now + 120}), hs256(secret), true},
+		{"sub and name missing", hmacOnly, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"exp": now + 600}, hs256(secret), true},
+		{"issuer and audience", scoped, map[string]interface{}{"alg": "HS256"}, valid(map[string]interface{}{"iss": "https://issuer.example", "aud": []string{"other", "bushitsu"}}), hs256(secret), false},
+		{"wrong issuer", scoped, map[string]interface{}{"alg": "HS256"}, valid(map[string]interface{}{"iss": "https://evil.example", "aud": "bushitsu"}), hs256(secret), true},
+		{"wrong audience", scoped, map[string]interface{}{"alg": "HS256"}, valid(map[string]interface{}{"iss": "https://issuer.example", "aud": "other"}), hs256(secret), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := testJWT(t, tt.header, tt.claims, tt.sign)
+			claims, err := tt.verifier.Verify(token)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidJWT) {
+					t.Fatalf("Verify() error = %v, want %v", err, errInvalidJWT)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if claims.Subject != "alice" {
+				t.Errorf("Verify() subject = %q, want %q", claims.Subject, "alice")
+			}
+		})
+	}
+}
+
+func TestJWTVerifierVerifyMalformed(t *testing.T) {
+	verifier := &JWTVerifier{secret: []byte("test-secret")}
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!!!.e30.", "e30.!!!.", "e30.e30.!!!"} {
+		if _, err := verifier.Verify(token); !errors.Is(err, errInvalidJWT) {
+			t.Errorf("Verify(%q) error = %v, want %v", token, err, errInvalidJWT)
+		}
+	}
+}
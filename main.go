@@ -7,12 +7,14 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -25,13 +27,67 @@ var allowDynamicRooms = flag.Bool("allow-dynamic-rooms", false, "allow dynamic r
 var authUser = flag.String("auth-user", "", "basic auth username for web UI (requires auth-password)")
 var authPassword = flag.String("auth-password", "", "basic auth password for web UI (requires auth-user)")
 var allowedOrigins = flag.String("allowed-origins", "", "comma-separated list of allowed origins for CORS (empty allows all)")
+var historyBackend = flag.String("history-backend", "memory", "message history storage backend (memory or file)")
+var historyFile = flag.String("history-file", "history.jsonl", "path of the history file used by the file backend")
+var historyLimit = flag.Int("history-limit", 1000, "maximum number of messages kept in memory per room")
+var requireToken = flag.Bool("require-token", false, "require a bearer token for WebSocket and REST API access")
+var adminToken = flag.String("admin-token", "", "bootstrap bearer token with server-admin scope")
+var tokenFile = flag.String("token-file", "", "path of the JSON file used to persist issued API tokens")
+var jwtSecret = flag.String("jwt-secret", "", "shared secret for verifying HS256 identity tokens")
+var jwtKeys = flag.String("jwt-keys", "", "JWKS or PEM file with public keys for verifying RS256/EdDSA identity tokens")
+var jwtIssuer = flag.String("jwt-issuer", "", "required iss claim of identity tokens")
+var jwtAudience = flag.String("jwt-audience", "", "required aud claim of identity tokens")
+var requireJWT = flag.Bool("require-jwt", false, "require a JWT for WebSocket connections and take the user name from its claims")
+var namePolicy = flag.String("name-policy", "allow", "handling of duplicate names in a room (allow, reject, suffix or principal)")
+var allowDirectMessages = flag.Bool("allow-direct-messages", false, "allow clients with the dm scope to send direct messages to users in other rooms")
+var historyReplay = flag.Int("history-replay", 50, "default number of recent messages replayed to clients on join")
+var messageTypesFile = flag.String("message-types", "", "JSON file defining custom message types")
+var trustProxy = flag.Bool("trust-proxy", false, "take client IP addresses from the last X-Forwarded-For entry or X-Real-IP")
+var rateLimitFile = flag.String("rate-limit-config", "", "JSON file with rate limits and per-role overrides")
+var rateLimitAction = flag.String("rate-limit-action", "", "action when a rate limit is exceeded: drop, delay, error or disconnect (default error)")
+var rateLimitSession = flag.String("rate-limit-session", "", "messages per second and burst per connection, as rate:burst")
+var rateLimitName = flag.String("rate-limit-name", "", "messages per second and burst per user name, as rate:burst")
+var rateLimitIP = flag.String("rate-limit-ip", "", "messages per second and burst per client IP, as rate:burst")
+var rateLimitRoom = flag.String("rate-limit-room", "", "messages per second and burst per room, as rate:burst")
+var moderationFile = flag.String("moderation-file", "", "JSON file to persist bans and mutes across restarts (empty keeps them in memory)")
+var blocklistFile = flag.String("blocklist", "", "file of blocked words and /regular expressions/, reloaded when it changes")
+var urlAllow = flag.String("url-allow", "", "comma-separated domains links may point to (empty allows all)")
+var urlDeny = flag.String("url-deny", "", "comma-separated domains links must not point to")
+var urlAction = flag.String("url-action", filterActionReject, "action for links that are not allowed: mask, hold or reject")
+var spamRepeats = flag.Int("spam-repeats", 0, "identical messages a user may send per -spam-window (0 disables the check)")
+var spamWindow = flag.Duration("spam-window", 30*time.Second, "time window of the repeated message check")
+var spamMaxRun = flag.Int("spam-max-run", 0, "longest run of one repeated character, longer runs are shortened (0 disables the check)")
+var webhookFile = flag.String("webhook-file", "", "JSON file to persist registered webhooks across restarts (empty keeps them in memory)")
+var webhookRetries = flag.Int("webhook-retries", 5, "retries of a failed webhook delivery before it goes to the dead letters")
+var webhookBackoff = flag.Duration("webhook-backoff", time.Second, "wait before the first webhook retry, doubled for each further retry")
+var webhookDeadLetters = flag.String("webhook-dead-letters", "", "JSON Lines file recording webhook deliveries that were given up on")
+var maxMetadataSize = flag.Int("max-metadata-size", defaultMetadataSize, "maximum size in bytes of the metadata object of a chat message")
 
 var upgrader websocket.Upgrader
 
-func serveWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
+func serveWS(hub *Hub, auth *Authenticator, w http.ResponseWriter, r *http.Request) {
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !principal.HasScope(scopeRead) {
+		http.Error(w, "read scope required", http.StatusForbidden)
+		return
+	}
+	if auth.requireJWT && principal.Name == "" {
+		http.Error(w, "JWT required", http.StatusUnauthorized)
+		return
+	}
+
 	room := r.URL.Query().Get("room")
 	name := r.URL.Query().Get("name")
 
+	// A JWT binds the name, the query parameter is ignored
+	if principal.Name != "" {
+		name = principal.Name
+	}
+
 	if room == "" {
 		room = "lobby"
 	}
@@ -40,13 +96,77 @@ func serveWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	clientType := r.URL.Query().Get("clientType")
+	if len(clientType) > maxClientTypeLength || validateChars(clientType) != nil {
+		http.Error(w, fmt.Sprintf("clientType must be at most %d bytes without control characters", maxClientTypeLength), http.StatusBadRequest)
+		return
+	}
+
+	// Profile fields may be given here or later with a hello message
+	profile := profileFromQuery(r)
+	if err := profile.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := profile.allowedFor(principal); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Number of history messages to replay, negative uses the room default
+	historySize := -1
+	if value := r.URL.Query().Get("history"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "history parameter must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		historySize = min(n, *historyLimit)
+	}
+
+	// Sequence number to resume from after a reconnect
+	var since uint64
+	resume := r.URL.Query().Has("since")
+	if resume {
+		var err error
+		since, err = strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "since parameter must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Check if room is allowed
 	if !hub.IsRoomAllowed(room) {
 		http.Error(w, "Room does not exist", http.StatusForbidden)
 		return
 	}
+	if !principal.CanJoin(room) {
+		http.Error(w, "Room not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Bans apply to the name, token subject and IP of the connection
+	ip := clientIP(r, *trustProxy)
+	if _, banned := hub.Moderation().Banned(room, name, principal, ip); banned {
+		log.Printf("[WARN] Rejected banned connection: name=%s, room=%s, ip=%s", name, room, ip)
+		http.Error(w, "Banned", http.StatusForbidden)
+		return
+	}
+
+	// Check the room member limit
+	if !hub.HasCapacity(room) {
+		http.Error(w, "Room is full", http.StatusForbidden)
+		return
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Echo the bearer subprotocol when the token was passed that way
+	var responseHeader http.Header
+	if _, viaSubprotocol := bearerCredential(r); viaSubprotocol {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {bearerSubprotocol}}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Printf("[ERROR] Failed to upgrade connection: %v", err)
 		return
@@ -62,12 +182,26 @@ func serveWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		send: make(chan []byte, 1024),
 		room: room,
 		name: name,
+		ip:   ip,
+
+		admitted:   make(chan bool, 1),
+		clientType: clientType,
+		profile:    profile.apply(Profile{}),
+
+		principal:   principal,
+		historySize: historySize,
+		resume:      resume,
+		since:       since,
 	}
 
 	client.hub.register <- client
 
+	// The hub may rename the client or reject it when the name is taken
+	admitted := <-client.admitted
 	go client.writeLoop()
-	go client.readLoop()
+	if admitted {
+		go client.readLoop()
+	}
 }
 
 // basicAuth performs HTTP Basic Authentication
@@ -142,12 +276,59 @@ type RoomsResponse struct {
 
 type CreateRoomRequest struct {
 	Name string `json:"name"`
+	RoomConfig
 }
 
+type UpdateRoomRequest struct {
+	Name   string `json:"name,omitempty"`   // New room name
+	Policy string `json:"policy,omitempty"` // "move" (default) or "disconnect"
+	RoomUpdate
+}
+
+// Limits for room metadata
+const (
+	maxTopicLength       = 256
+	maxDescriptionLength = 1024
+	maxRoomAttributes    = 32
+	maxAttributeKey      = 64
+	maxAttributeValue    = 1024
+)
+
+// maxClientTypeLength limits the client type given when connecting
+const maxClientTypeLength = 32
+
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+type MembersResponse struct {
+	Room    string       `json:"room"`
+	Members []MemberInfo `json:"members"`
+}
+
+type MessagesResponse struct {
+	Room     string          `json:"room"`
+	Messages []StoredMessage `json:"messages"`
+	HasMore  bool            `json:"hasMore"`
+}
+
+const (
+	defaultPageSize = 50  // Default number of messages per history page
+	maxPageSize     = 500 // Maximum number of messages per history page
+)
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: message})
+}
+
 // handleCreateRoom handles POST /api/rooms
 func handleCreateRoom(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -157,29 +338,26 @@ func handleCreateRoom(hub *Hub, w http.ResponseWriter, r *http.Request) {
 
 	var req CreateRoomRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		writeError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
 	if req.Name == "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Room name is required"})
+		writeError(w, http.StatusBadRequest, "Room name is required")
 		return
 	}
 
-	if err := hub.CreateRoom(req.Name); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+	if err := validateRoomConfig(req.RoomConfig); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "created", "name": req.Name})
+	if err := hub.CreateRoom(req.Name, req.RoomConfig); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "created", "name": req.Name})
 }
 
 // handleGetRooms handles GET /api/rooms
@@ -195,9 +373,335 @@ func handleGetRooms(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(RoomsResponse{Rooms: rooms})
 }
 
+// handleDeleteRoom handles DELETE /api/rooms/{name}
+func handleDeleteRoom(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	policy := r.URL.Query().Get("policy")
+	target := r.URL.Query().Get("target")
+
+	switch policy {
+	case "":
+		policy = roomPolicyDisconnect
+	case roomPolicyDisconnect, roomPolicyMove:
+	default:
+		writeError(w, http.StatusBadRequest, "policy must be disconnect or move")
+		return
+	}
+	if policy == roomPolicyMove && target == "" {
+		target = "lobby"
+	}
+
+	if err := hub.DeleteRoom(name, policy, target); err != nil {
+		writeRoomError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "name": name})
+}
+
+// handleUpdateRoom handles PATCH /api/rooms/{name}
+func handleUpdateRoom(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var req UpdateRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	switch req.Policy {
+	case "":
+		req.Policy = roomPolicyMove
+	case roomPolicyDisconnect, roomPolicyMove:
+	default:
+		writeError(w, http.StatusBadRequest, "policy must be move or disconnect")
+		return
+	}
+
+	if req.Name == name {
+		req.Name = ""
+	}
+	if req.Name == "" && req.RoomUpdate.empty() {
+		writeError(w, http.StatusBadRequest, "Nothing to update")
+		return
+	}
+
+	if err := validateRoomUpdate(req.RoomUpdate); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Check the new settings before renaming, so a refused update leaves the
+	// room as it was
+	if req.Name != "" && !req.RoomUpdate.empty() {
+		if err := hub.CheckRoomUpdate(name, req.RoomUpdate); err != nil {
+			writeRoomError(w, err)
+			return
+		}
+	}
+
+	resp := map[string]string{"status": "updated", "name": name}
+	if req.Name != "" {
+		if err := hub.RenameRoom(name, req.Name, req.Policy); err != nil {
+			writeRoomError(w, err)
+			return
+		}
+		resp = map[string]string{"status": "renamed", "name": req.Name, "previous": name}
+		name = req.Name
+	}
+
+	if !req.RoomUpdate.empty() {
+		if err := hub.UpdateRoom(name, req.RoomUpdate); err != nil {
+			writeRoomError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// validateRoomConfig checks the settings of a room to be created
+func validateRoomConfig(config RoomConfig) error {
+	update := RoomUpdate{
+		HistorySize: config.HistorySize,
+		Topic:       &config.Topic,
+		Description: &config.Description,
+		MaxMembers:  &config.MaxMembers,
+	}
+	if config.Visibility != "" {
+		update.Visibility = &config.Visibility
+	}
+	if config.NamePolicy != "" {
+		update.NamePolicy = &config.NamePolicy
+	}
+	if len(config.Attributes) > 0 {
+		update.Attributes = make(map[string]*string, len(config.Attributes))
+		for key, value := range config.Attributes {
+			update.Attributes[key] = &value
+		}
+	}
+	return validateRoomUpdate(update)
+}
+
+// validateRoomUpdate checks the settings of a room update
+func validateRoomUpdate(update RoomUpdate) error {
+	if update.HistorySize != nil && (*update.HistorySize < 0 || *update.HistorySize > *historyLimit) {
+		return fmt.Errorf("history must be between 0 and %d", *historyLimit)
+	}
+	if update.Topic != nil && len(*update.Topic) > maxTopicLength {
+		return fmt.Errorf("topic must be at most %d bytes", maxTopicLength)
+	}
+	if update.Description != nil && len(*update.Description) > maxDescriptionLength {
+		return fmt.Errorf("description must be at most %d bytes", maxDescriptionLength)
+	}
+	if update.MaxMembers != nil && *update.MaxMembers < 0 {
+		return errors.New("maxMembers must not be negative")
+	}
+	if update.Visibility != nil && *update.Visibility != roomVisibilityPublic && *update.Visibility != roomVisibilityUnlisted {
+		return errors.New("visibility must be public or unlisted")
+	}
+	if update.NamePolicy != nil && *update.NamePolicy != "" && !validNamePolicy(*update.NamePolicy) {
+		return errors.New("namePolicy must be allow, reject, suffix or principal")
+	}
+	if len(update.Attributes) > maxRoomAttributes {
+		return fmt.Errorf("at most %d attributes are allowed", maxRoomAttributes)
+	}
+	for key, value := range update.Attributes {
+		if key == "" || len(key) > maxAttributeKey {
+			return fmt.Errorf("attribute keys must be 1 to %d bytes", maxAttributeKey)
+		}
+		if value != nil && len(*value) > maxAttributeValue {
+			return fmt.Errorf("attribute values must be at most %d bytes", maxAttributeValue)
+		}
+	}
+	return nil
+}
+
+// writeRoomError maps a room management error to an HTTP response
+func writeRoomError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRoomNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errRoomExists):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+// handleGetRoomMessages handles GET /api/rooms/{name}/messages
+func handleGetRoomMessages(hub *Hub, auth *Authenticator, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// A JWT limited to some rooms may only read those
+	room := r.PathValue("name")
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !principal.CanJoin(room) {
+		writeError(w, http.StatusForbidden, "Room not allowed")
+		return
+	}
+	if !hub.IsRoomAllowed(room) {
+		writeError(w, http.StatusNotFound, "Room does not exist")
+		return
+	}
+
+	params := r.URL.Query()
+	q := MessageQuery{
+		Room:   room,
+		Limit:  defaultPageSize,
+		From:   params.Get("from"),
+		FromId: params.Get("fromId"),
+		Type:   params.Get("type"),
+	}
+
+	// Whispers and direct messages are left out of the transcript. Clients
+	// with a name bound by a JWT see their own, moderators may ask for all
+	q.Viewer = principal.Name
+	if params.Get("includePrivate") == "true" {
+		if !principal.IsModerator() {
+			writeError(w, http.StatusForbidden, "includePrivate requires the moderate scope")
+			return
+		}
+		q.Private = true
+	}
+
+	if q.Before, err = parseSeqParam(params.Get("before")); err != nil {
+		writeError(w, http.StatusBadRequest, "before must be a positive integer")
+		return
+	}
+	if q.After, err = parseSeqParam(params.Get("after")); err != nil {
+		writeError(w, http.StatusBadRequest, "after must be a positive integer")
+		return
+	}
+	if value := params.Get("limit"); value != "" {
+		q.Limit, err = strconv.Atoi(value)
+		if err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+	}
+
+	messages, hasMore, err := hub.GetMessages(q)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query history for room %s: %v", room, err)
+		writeError(w, http.StatusInternalServerError, "Failed to load messages")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, MessagesResponse{Room: room, Messages: messages, HasMore: hasMore})
+}
+
+// handleGetRoomMembers handles GET /api/rooms/{name}/members
+func handleGetRoomMembers(hub *Hub, auth *Authenticator, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// A JWT limited to some rooms may only list members of those
+	room := r.PathValue("name")
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !principal.CanJoin(room) {
+		writeError(w, http.StatusForbidden, "Room not allowed")
+		return
+	}
+	members, active := hub.GetMembers(room)
+	if !active && !hub.IsRoomAllowed(room) {
+		writeError(w, http.StatusNotFound, "Room does not exist")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, MembersResponse{Room: room, Members: members})
+}
+
+// parseSeqParam parses an optional sequence number cursor
+func parseSeqParam(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// withCORS applies the configured CORS policy before calling next
+func withCORS(allowedOrigins []string, methods string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Configure CORS headers based on allowed origins
+		origin := r.Header.Get("Origin")
+		if len(allowedOrigins) == 0 {
+			// Allow all origins if none specified
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// Check if origin is allowed
+			originAllowed := false
+			for _, allowed := range allowedOrigins {
+				if origin == allowed {
+					originAllowed = true
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					break
+				}
+			}
+			if !originAllowed && origin != "" {
+				log.Printf("[WARN] Rejected API request from origin: %s", origin)
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
 func main() {
 	flag.Parse()
-	hub := NewHub()
+
+	store, err := NewMessageStore(*historyBackend, *historyFile, *historyLimit)
+	if err != nil {
+		log.Fatal("[ERROR] Failed to initialize message history: ", err)
+	}
+	log.Printf("[INFO] Message history backend: %s (limit %d per room)", *historyBackend, *historyLimit)
+
+	hub := NewHub(store)
+
+	tokens, err := NewTokenStore(*tokenFile)
+	if err != nil {
+		log.Fatal("[ERROR] Failed to initialize API tokens: ", err)
+	}
+	auth := NewAuthenticator(tokens, *requireToken, *adminToken)
+	if *jwtSecret != "" || *jwtKeys != "" {
+		verifier, err := NewJWTVerifier(*jwtSecret, *jwtKeys, *jwtIssuer, *jwtAudience)
+		if err != nil {
+			log.Fatal("[ERROR] Failed to initialize JWT verification: ", err)
+		}
+		auth.SetJWTVerifier(verifier, *requireJWT)
+		log.Printf("[INFO] JWT identities enabled (required=%v)", *requireJWT)
+	} else if *requireJWT {
+		log.Fatal("[ERROR] -require-jwt needs -jwt-secret or -jwt-keys")
+	}
+	if *requireToken {
+		log.Printf("[INFO] Bearer token authentication required for WebSocket and API access")
+		if *adminToken == "" && len(tokens.List()) == 0 {
+			log.Printf("[WARN] No admin token or issued tokens configured, nobody can connect")
+		}
+	}
 	
 	// Configure allowed origins
 	var allowedOriginsList []string
@@ -232,58 +736,154 @@ func main() {
 	
 	// Set dynamic room creation policy
 	hub.SetAllowDynamicRooms(*allowDynamicRooms)
+	hub.SetHistorySize(min(*historyReplay, *historyLimit))
+	if !validNamePolicy(*namePolicy) {
+		log.Fatal("[ERROR] -name-policy must be allow, reject, suffix or principal")
+	}
+	hub.SetNamePolicy(*namePolicy)
+	hub.SetDirectMessages(*allowDirectMessages)
+	if *maxMetadataSize <= 0 || *maxMetadataSize > maxMessageSize {
+		log.Fatalf("[ERROR] -max-metadata-size must be between 1 and %d", maxMessageSize)
+	}
+	hub.SetMaxMetadataSize(*maxMetadataSize)
+	moderation, err := NewModerationStore(*moderationFile)
+	if err != nil {
+		log.Fatal("[ERROR] Failed to initialize moderation: ", err)
+	}
+	hub.SetModeration(moderation)
+	webhooks, err := NewWebhookStore(*webhookFile)
+	if err != nil {
+		log.Fatal("[ERROR] Failed to initialize webhooks: ", err)
+	}
+	if *webhookRetries < 0 || *webhookBackoff <= 0 {
+		log.Fatal("[ERROR] -webhook-retries must not be negative and -webhook-backoff must be positive")
+	}
+	dispatcher := NewWebhookDispatcher(webhooks, *webhookRetries, *webhookBackoff, *webhookDeadLetters)
+	hub.SetWebhooks(dispatcher)
+	if err := configureRateLimits(hub); err != nil {
+		log.Fatal("[ERROR] Invalid rate limits: ", err)
+	}
+	if err := configureFilters(hub); err != nil {
+		log.Fatal("[ERROR] Invalid content filters: ", err)
+	}
+	if *messageTypesFile != "" {
+		types, err := loadMessageTypes(*messageTypesFile)
+		if err != nil {
+			log.Fatal("[ERROR] Failed to load message types: ", err)
+		}
+		hub.SetMessageTypes(types)
+		log.Printf("[INFO] Loaded %d custom message types from %s", len(types), *messageTypesFile)
+	}
 	
 	// If dynamic rooms are not allowed, create a default "lobby" room
 	if !*allowDynamicRooms {
-		hub.CreateRoom("lobby")
+		hub.CreateRoom("lobby", RoomConfig{})
 	}
 	
 	go hub.run()
 
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWS(hub, w, r)
+		serveWS(hub, auth, w, r)
 	})
-	http.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {
-		// Configure CORS headers based on allowed origins
-		origin := r.Header.Get("Origin")
-		if len(allowedOriginsList) == 0 {
-			// Allow all origins if none specified
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-		} else {
-			// Check if origin is allowed
-			originAllowed := false
-			for _, allowed := range allowedOriginsList {
-				if origin == allowed {
-					originAllowed = true
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-					break
-				}
-			}
-			if !originAllowed && origin != "" {
-				log.Printf("[WARN] Rejected API request from origin: %s", origin)
-				http.Error(w, "Origin not allowed", http.StatusForbidden)
-				return
-			}
+	http.HandleFunc("/api/rooms", withCORS(allowedOriginsList, "GET, POST, OPTIONS", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			requireScope(auth, scopeRead, func(w http.ResponseWriter, r *http.Request) {
+				handleGetRooms(hub, w, r)
+			})(w, r)
+		case http.MethodPost:
+			requireScope(auth, scopeRoomAdmin, func(w http.ResponseWriter, r *http.Request) {
+				handleCreateRoom(hub, w, r)
+			})(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
-		
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
+	}))
+	http.HandleFunc("/api/rooms/{name}", withCORS(allowedOriginsList, "PATCH, DELETE, OPTIONS", requireScope(auth, scopeRoomAdmin, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPatch:
+			handleUpdateRoom(hub, w, r)
+		case http.MethodDelete:
+			handleDeleteRoom(hub, w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.HandleFunc("/api/rooms/{name}/messages", withCORS(allowedOriginsList, "GET, OPTIONS", requireScope(auth, scopeRead, func(w http.ResponseWriter, r *http.Request) {
+		handleGetRoomMessages(hub, auth, w, r)
+	})))
+	http.HandleFunc("/api/rooms/{name}/members", withCORS(allowedOriginsList, "GET, OPTIONS", requireScope(auth, scopeRead, func(w http.ResponseWriter, r *http.Request) {
+		handleGetRoomMembers(hub, auth, w, r)
+	})))
+	http.HandleFunc("/api/rooms/{name}/pending", withCORS(allowedOriginsList, "GET, OPTIONS", requireModerator(auth, func(w http.ResponseWriter, r *http.Request) {
+		handleGetPending(hub, w, r)
+	})))
+	http.HandleFunc("/api/rooms/{name}/pending/{id}", withCORS(allowedOriginsList, "POST, OPTIONS", requireModerator(auth, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		
+		handleReview(hub, auth, w, r)
+	})))
+	http.HandleFunc("/api/tokens", withCORS(allowedOriginsList, "GET, POST, OPTIONS", requireAuthenticated(auth, scopeServerAdmin, func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			handleGetRooms(hub, w, r)
+			handleGetTokens(tokens, w, r)
 		case http.MethodPost:
-			handleCreateRoom(hub, w, r)
+			handleCreateToken(tokens, w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
-	})
+	})))
+	http.HandleFunc("/api/tokens/{id}", withCORS(allowedOriginsList, "DELETE, OPTIONS", requireAuthenticated(auth, scopeServerAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleRevokeToken(hub, tokens, w, r)
+	})))
+	http.HandleFunc("/api/moderation", withCORS(allowedOriginsList, "GET, POST, OPTIONS", requireModerator(auth, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetSanctions(hub, w, r)
+		case http.MethodPost:
+			handleModerate(hub, auth, w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.HandleFunc("/api/moderation/{id}", withCORS(allowedOriginsList, "DELETE, OPTIONS", requireModerator(auth, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleLiftSanction(hub, auth, w, r)
+	})))
+	http.HandleFunc("/api/webhooks", withCORS(allowedOriginsList, "GET, POST, OPTIONS", requireScope(auth, scopeServerAdmin, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetWebhooks(webhooks, w, r)
+		case http.MethodPost:
+			handleCreateWebhook(webhooks, w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.HandleFunc("/api/webhooks/{id}", withCORS(allowedOriginsList, "DELETE, OPTIONS", requireScope(auth, scopeServerAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleDeleteWebhook(webhooks, w, r)
+	})))
+	http.HandleFunc("/api/webhooks/dead-letters", withCORS(allowedOriginsList, "GET, OPTIONS", requireScope(auth, scopeServerAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleGetDeadLetters(dispatcher, w, r)
+	})))
 
 	server := &http.Server{
 		Addr: *addr,
@@ -316,17 +916,118 @@ func main() {
 	// Shutdown the hub
 	hub.shutdown()
 
+	// Flush and close the message history
+	if err := store.Close(); err != nil {
+		log.Printf("[ERROR] Failed to close message history: %v", err)
+	}
+
 	log.Println("[INFO] Server gracefully stopped")
 }
 
+// configureRateLimits loads the rate limit file and applies the rate limit
+// flags on top of it. Without any limits the hub is left unlimited
+func configureRateLimits(hub *Hub) error {
+	var config RateLimitConfig
+	if *rateLimitFile != "" {
+		var err error
+		if config, err = loadRateLimitConfig(*rateLimitFile); err != nil {
+			return err
+		}
+	}
+	if *rateLimitAction != "" {
+		config.Action = *rateLimitAction
+	}
+	for _, f := range []struct {
+		name  string
+		value string
+		limit **RateLimit
+	}{
+		{"rate-limit-session", *rateLimitSession, &config.Session},
+		{"rate-limit-name", *rateLimitName, &config.Name},
+		{"rate-limit-ip", *rateLimitIP, &config.IP},
+		{"rate-limit-room", *rateLimitRoom, &config.Room},
+	} {
+		if f.value == "" {
+			continue
+		}
+		limit, err := parseRateLimit(f.value)
+		if err != nil {
+			return fmt.Errorf("-%s: %w", f.name, err)
+		}
+		*f.limit = limit
+	}
+
+	if config.Session == nil && config.Name == nil && config.IP == nil && config.Room == nil && len(config.Roles) == 0 {
+		return nil
+	}
+	limiter, err := NewRateLimiter(config)
+	if err != nil {
+		return err
+	}
+	hub.SetRateLimiter(limiter)
+	log.Printf("[INFO] Rate limits enabled (action %s, %d role overrides)", limiter.defaults.Action, len(config.Roles))
+	return nil
+}
+
+// configureFilters builds the content filter chain from the filter flags.
+// Without filters the hub delivers text unchanged
+func configureFilters(hub *Hub) error {
+	filters := &FilterChain{}
+	if *blocklistFile != "" {
+		blocklist, err := NewBlocklistFilter(*blocklistFile)
+		if err != nil {
+			return err
+		}
+		filters.Use(blocklist)
+	}
+	if *urlAllow != "" || *urlDeny != "" {
+		urls, err := NewURLFilter(splitList(*urlAllow), splitList(*urlDeny), *urlAction)
+		if err != nil {
+			return err
+		}
+		filters.Use(urls)
+	}
+	if *spamRepeats < 0 || *spamMaxRun < 0 || *spamWindow <= 0 {
+		return fmt.Errorf("-spam-repeats and -spam-max-run must not be negative, -spam-window must be positive")
+	}
+	if *spamRepeats > 0 || *spamMaxRun > 0 {
+		filters.Use(NewSpamFilter(*spamRepeats, *spamWindow, *spamMaxRun))
+	}
+
+	if filters.Len() == 0 {
+		return nil
+	}
+	hub.SetFilters(filters)
+	log.Printf("[INFO] Content filters enabled (%d filters)", filters.Len())
+	return nil
+}
+
+// splitList splits a comma-separated flag value
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
 // generateSessionID generates a unique session ID
 func generateSessionID() string {
+	return generateID("session")
+}
+
+// generateMessageID generates a unique message ID
+func generateMessageID() string {
+	return generateID("msg")
+}
+
+// generateID generates a random ID with the given prefix
+func generateID(prefix string) string {
 	bytes := make([]byte, 16)
 	if _, err := rand.Read(bytes); err != nil {
 		// Fallback to timestamp-based ID if random generation fails
-		log.Printf("[WARN] Failed to generate random session ID: %v, using timestamp", err)
+		log.Printf("[WARN] Failed to generate random %s ID: %v, using timestamp", prefix, err)
 		timestamp := time.Now().UnixNano()
-		return fmt.Sprintf("session-%d", timestamp)
+		return fmt.Sprintf("%s-%d", prefix, timestamp)
 	}
-	return "session-" + hex.EncodeToString(bytes)
+	return prefix + "-" + hex.EncodeToString(bytes)
 }
\ No newline at end of file
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Moderation actions
+const (
+	moderationKick    = "kick"    // Disconnect matching clients
+	moderationBan     = "ban"     // Refuse connections and disconnect matching clients
+	moderationUnban   = "unban"   // Lift matching bans
+	moderationMute    = "mute"    // Reject messages of a name, optionally for a duration
+	moderationTimeout = "timeout" // Mute for a required duration
+	moderationUnmute  = "unmute"  // Lift matching mutes
+)
+
+// What a moderation action applies to
+const (
+	targetName    = "name"    // Chat name
+	targetSession = "session" // Session ID of a connected client
+	targetSubject = "subject" // Token name or JWT subject
+	targetIP      = "ip"      // Client IP address
+)
+
+// Kinds of stored sanctions
+const (
+	sanctionBan  = "ban"
+	sanctionMute = "mute"
+)
+
+// Limits for moderation requests
+const (
+	maxModerationValueLength  = 256
+	maxModerationReasonLength = 256
+	maxModerationDuration     = 10 * 365 * 24 * 60 * 60 // Ten years in seconds
+)
+
+// moderationTargets lists the targets each action accepts
+var moderationTargets = map[string][]string{
+	moderationKick:    {targetSession, targetName, targetSubject, targetIP},
+	moderationBan:     {targetSession, targetName, targetSubject, targetIP},
+	moderationUnban:   {targetName, targetSubject, targetIP},
+	moderationMute:    {targetSession, targetName},
+	moderationTimeout: {targetSession, targetName},
+	moderationUnmute:  {targetSession, targetName},
+}
+
+// moderationEvents names the system event announcing each action
+var moderationEvents = map[string]string{
+	moderationKick:    "user_kicked",
+	moderationBan:     "user_banned",
+	moderationUnban:   "user_unbanned",
+	moderationMute:    "user_muted",
+	moderationTimeout: "user_muted",
+	moderationUnmute:  "user_unmuted",
+}
+
+var errSanctionNotFound = errors.New("sanction not found")
+
+// Sanction is a stored ban or mute
+type Sanction struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`   // "ban" or "mute"
+	Target    string     `json:"target"` // "name", "subject" or "ip"
+	Value     string     `json:"value"`
+	Room      string     `json:"room,omitempty"` // Empty applies to every room
+	Reason    string     `json:"reason,omitempty"`
+	By        string     `json:"by"` // Moderator name or API token subject
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// expired reports whether the sanction has ended
+func (s *Sanction) expired(now time.Time) bool {
+	return s.ExpiresAt != nil && now.After(*s.ExpiresAt)
+}
+
+// appliesTo reports whether the sanction covers a connection with the given
+// identity. Subjects never match anonymous principals
+func (s *Sanction) appliesTo(room, name string, principal *Principal, ip, session string) bool {
+	if s.Room != "" && s.Room != room {
+		return false
+	}
+	switch s.Target {
+	case targetName:
+		return s.Value == name
+	case targetSubject:
+		return principal != nil && principal != anonymousPrincipal && s.Value == principal.Subject
+	case targetIP:
+		return s.Value == ip
+	case targetSession:
+		return s.Value == session
+	}
+	return false
+}
+
+// matches reports whether the sanction covers a connected client, must be
+// called from the hub loop or with the hub lock held
+func (s *Sanction) matches(c *Client) bool {
+	return s.appliesTo(c.room, c.name, c.principal, c.ip, c.id)
+}
+
+// ModerationStore keeps bans and mutes, optionally persisted to a JSON file
+type ModerationStore struct {
+	mu        sync.RWMutex
+	path      string
+	sanctions map[string]*Sanction // Keyed by ID
+}
+
+// NewModerationStore creates a moderation store, loading sanctions from path
+// if it is set. Expired sanctions are dropped
+func NewModerationStore(path string) (*ModerationStore, error) {
+	s := &ModerationStore{path: path, sanctions: make(map[string]*Sanction)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read moderation file: %w", err)
+	}
+
+	var sanctions []*Sanction
+	if err := json.Unmarshal(data, &sanctions); err != nil {
+		return nil, fmt.Errorf("failed to parse moderation file: %w", err)
+	}
+	now := time.Now()
+	for _, sanction := range sanctions {
+		if !sanction.expired(now) {
+			s.sanctions[sanction.ID] = sanction
+		}
+	}
+	log.Printf("[INFO] Loaded %d bans and mutes from %s", len(s.sanctions), path)
+	return s, nil
+}
+
+// Add stores a new sanction and returns it with its ID
+func (s *ModerationStore) Add(sanction Sanction) (Sanction, error) {
+	sanction.ID = generateID("mod")
+	sanction.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sanctions[sanction.ID] = &sanction
+	if err := s.save(); err != nil {
+		delete(s.sanctions, sanction.ID)
+		return Sanction{}, err
+	}
+	return sanction, nil
+}
+
+// Lift removes the sanction with the given ID
+func (s *ModerationStore) Lift(id string) (Sanction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sanction, ok := s.sanctions[id]
+	if !ok || sanction.expired(time.Now()) {
+		return Sanction{}, fmt.Errorf("%w: %s", errSanctionNotFound, id)
+	}
+	delete(s.sanctions, id)
+	if err := s.save(); err != nil {
+		s.sanctions[id] = sanction
+		return Sanction{}, err
+	}
+	return *sanction, nil
+}
+
+// LiftMatching removes the active sanctions of a kind on target and value in
+// room, and returns them
+func (s *ModerationStore) LiftMatching(kind, target, value, room string) ([]Sanction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var lifted []*Sanction
+	for id, sanction := range s.sanctions {
+		if sanction.Kind == kind && sanction.Target == target && sanction.Value == value &&
+			sanction.Room == room && !sanction.expired(now) {
+			lifted = append(lifted, sanction)
+			delete(s.sanctions, id)
+		}
+	}
+	if len(lifted) == 0 {
+		return nil, nil
+	}
+	if err := s.save(); err != nil {
+		for _, sanction := range lifted {
+			s.sanctions[sanction.ID] = sanction
+		}
+		return nil, err
+	}
+
+	result := make([]Sanction, len(lifted))
+	for i, sanction := range lifted {
+		result[i] = *sanction
+	}
+	return result, nil
+}
+
+// RenameRoom moves the sanctions of a room to its new name. They stay in
+// force even if saving them fails
+func (s *ModerationStore) RenameRoom(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for _, sanction := range s.sanctions {
+		if sanction.Room == from {
+			sanction.Room = to
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// List returns the active sanctions, oldest first
+func (s *ModerationStore) List() []Sanction {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	sanctions := make([]Sanction, 0, len(s.sanctions))
+	for _, sanction := range s.sanctions {
+		if !sanction.expired(now) {
+			sanctions = append(sanctions, *sanction)
+		}
+	}
+	sort.Slice(sanctions, func(i, j int) bool {
+		return sanctions[i].CreatedAt.Before(sanctions[j].CreatedAt)
+	})
+	return sanctions
+}
+
+// Banned returns the ban that keeps a connection out of room, if any
+func (s *ModerationStore) Banned(room, name string, principal *Principal, ip string) (Sanction, bool) {
+	return s.find(sanctionBan, func(sanction *Sanction) bool {
+		return sanction.appliesTo(room, name, principal, ip, "")
+	})
+}
+
+// Muted returns the mute that applies to a name in room, if any
+func (s *ModerationStore) Muted(room, name string) (Sanction, bool) {
+	return s.find(sanctionMute, func(sanction *Sanction) bool {
+		return sanction.appliesTo(room, name, nil, "", "")
+	})
+}
+
+// find returns an active sanction of a kind accepted by match
+func (s *ModerationStore) find(kind string, match func(*Sanction) bool) (Sanction, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, sanction := range s.sanctions {
+		if sanction.Kind == kind && !sanction.expired(now) && match(sanction) {
+			return *sanction, true
+		}
+	}
+	return Sanction{}, false
+}
+
+// save writes the active sanctions to the moderation file, caller must hold the lock
+func (s *ModerationStore) save() error {
+	now := time.Now()
+	for id, sanction := range s.sanctions {
+		if sanction.expired(now) {
+			delete(s.sanctions, id)
+		}
+	}
+	if s.path == "" {
+		return nil
+	}
+
+	sanctions := make([]*Sanction, 0, len(s.sanctions))
+	for _, sanction := range s.sanctions {
+		sanctions = append(sanctions, sanction)
+	}
+	if err := writeFileAtomic(s.path, sanctions); err != nil {
+		return fmt.Errorf("failed to write moderation file: %w", err)
+	}
+	return nil
+}
+
+// ModerationRequest is a moderation action sent by a moderator client or
+// through the moderation API
+type ModerationRequest struct {
+	Action   string `json:"action"` // "kick", "ban", "unban", "mute", "timeout" or "unmute"
+	Target   string `json:"target"` // "session", "name", "subject" or "ip"
+	Value    string `json:"value"`
+	Room     string `json:"room,omitempty"`     // Empty applies to every room, clients always act on their own room
+	Duration int    `json:"duration,omitempty"` // Seconds a ban or mute lasts, 0 never expires
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ModerationResult describes the outcome of a moderation action
+type ModerationResult struct {
+	Action       string     `json:"action"`
+	Disconnected int        `json:"disconnected"`        // Connections closed by a kick or ban
+	Sanctions    []Sanction `json:"sanctions,omitempty"` // Sanctions added or lifted
+}
+
+// SanctionsResponse lists the active bans and mutes
+type SanctionsResponse struct {
+	Sanctions []Sanction `json:"sanctions"`
+}
+
+// validate checks the fields of a moderation request
+func (req ModerationRequest) validate() error {
+	targets, ok := moderationTargets[req.Action]
+	if !ok {
+		return errors.New("action must be kick, ban, unban, mute, timeout or unmute")
+	}
+	if !slices.Contains(targets, req.Target) {
+		return fmt.Errorf("%s target must be one of %s", req.Action, strings.Join(targets, ", "))
+	}
+	if req.Value == "" {
+		return errors.New("moderation value is required")
+	}
+	if len(req.Value) > maxModerationValueLength {
+		return newClientError(errorTooLong, "value must be at most %d bytes", maxModerationValueLength)
+	}
+	if len(req.Reason) > maxModerationReasonLength {
+		return newClientError(errorTooLong, "reason must be at most %d bytes", maxModerationReasonLength)
+	}
+	if validateChars(req.Value) != nil || validateChars(req.Reason) != nil {
+		return errInvalidChars
+	}
+	if req.Duration < 0 || req.Duration > maxModerationDuration {
+		return fmt.Errorf("duration must be between 0 and %d seconds", maxModerationDuration)
+	}
+	if req.Action == moderationTimeout && req.Duration == 0 {
+		return errors.New("timeout requires a duration")
+	}
+	return nil
+}
+
+// Moderate applies a moderation request on behalf of by and announces it as
+// a system event. Must not be called from the hub loop
+func (h *Hub) Moderate(req ModerationRequest, by string) (ModerationResult, error) {
+	result := ModerationResult{Action: req.Action}
+	if err := req.validate(); err != nil {
+		return result, err
+	}
+	store := h.Moderation()
+
+	// A session stands for the user connected with it. Bans of a session
+	// outlive it, so they apply to its subject. Anonymous sessions have none,
+	// and widening to an IP ban could hit everyone behind the same address
+	target, value, user := req.Target, req.Value, ""
+	switch target {
+	case targetSession:
+		client, ok := h.findSession(value, req.Room)
+		if !ok {
+			return result, newClientError(errorNotFound, "session %s is not connected", value)
+		}
+		user = client.name
+		switch req.Action {
+		case moderationMute, moderationTimeout, moderationUnmute:
+			target, value = targetName, client.name
+		case moderationBan:
+			if client.principal == anonymousPrincipal {
+				return result, newClientError(errorInvalidMessage, "session %s has no credentials to ban, ban its name or ip instead", value)
+			}
+			target, value = targetSubject, client.principal.Subject
+		}
+	case targetName:
+		user = value
+	}
+
+	var expiresAt *time.Time
+	switch req.Action {
+	case moderationKick:
+		kick := &Sanction{Target: target, Value: value, Room: req.Room}
+		result.Disconnected = h.Disconnect(kick.matches, closeKicked, "kicked by a moderator")
+		if result.Disconnected == 0 {
+			return result, newClientError(errorNotFound, "no matching user is connected")
+		}
+
+	case moderationBan, moderationMute, moderationTimeout:
+		sanction := Sanction{Kind: sanctionMute, Target: target, Value: value, Room: req.Room, Reason: req.Reason, By: by}
+		if req.Action == moderationBan {
+			sanction.Kind = sanctionBan
+		}
+		if req.Duration > 0 {
+			expiry := time.Now().UTC().Add(time.Duration(req.Duration) * time.Second)
+			sanction.ExpiresAt = &expiry
+			expiresAt = &expiry
+		}
+		sanction, err := store.Add(sanction)
+		if err != nil {
+			log.Printf("[ERROR] Failed to store %s: %v", req.Action, err)
+			return result, newClientError(errorInternal, "failed to store %s", req.Action)
+		}
+		result.Sanctions = []Sanction{sanction}
+		if sanction.Kind == sanctionBan {
+			result.Disconnected = h.Disconnect(sanction.matches, closeBanned, "banned by a moderator")
+		}
+
+	case moderationUnban, moderationUnmute:
+		kind := sanctionBan
+		if req.Action == moderationUnmute {
+			kind = sanctionMute
+		}
+		lifted, err := store.LiftMatching(kind, target, value, req.Room)
+		if err != nil {
+			log.Printf("[ERROR] Failed to %s: %v", req.Action, err)
+			return result, newClientError(errorInternal, "failed to %s", req.Action)
+		}
+		if len(lifted) == 0 {
+			return result, newClientError(errorNotFound, "no matching %s", kind)
+		}
+		result.Sanctions = lifted
+	}
+
+	log.Printf("[INFO] Moderation: %s %s=%s room=%q by %s (%d disconnected)", req.Action, target, value, req.Room, by, result.Disconnected)
+	h.announceModeration(moderationEvents[req.Action], req.Room, user, by, req.Reason, expiresAt)
+	return result, nil
+}
+
+// LiftSanction removes a ban or mute by ID and announces it
+func (h *Hub) LiftSanction(id, by string) (Sanction, error) {
+	sanction, err := h.Moderation().Lift(id)
+	if err != nil {
+		return sanction, err
+	}
+
+	log.Printf("[INFO] Moderation: lifted %s %s=%s room=%q by %s", sanction.Kind, sanction.Target, sanction.Value, sanction.Room, by)
+	event, user := "user_unbanned", ""
+	if sanction.Kind == sanctionMute {
+		event = "user_unmuted"
+	}
+	if sanction.Target == targetName {
+		user = sanction.Value
+	}
+	h.announceModeration(event, sanction.Room, user, by, "", nil)
+	return sanction, nil
+}
+
+// announceModeration sends a moderation system event to room, or to every
+// active room for server-wide actions. Subjects and IP addresses are not
+// announced, only names
+func (h *Hub) announceModeration(event, room, user, by, reason string, expiresAt *time.Time) {
+	details := map[string]interface{}{"by": by}
+	if user != "" {
+		details["user"] = user
+	}
+	if reason != "" {
+		details["reason"] = reason
+	}
+	if expiresAt != nil {
+		details["expiresAt"] = expiresAt.Format(time.RFC3339)
+	}
+
+	rooms := []string{room}
+	if room == "" {
+		rooms = h.activeRooms()
+	}
+	for _, name := range rooms {
+		h.broadcast <- WebSocketMessage{
+			Type:      "system",
+			Room:      name,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Data:      SystemEventData{Event: event, Details: details},
+		}
+	}
+}
+
+// moderate applies a moderation command of a moderator client to its room
+func (c *Client) moderate(req ModerationRequest, clientMsgID string) {
+	if !c.principal.IsModerator() {
+		log.Printf("[WARN] Dropped moderation command from %s: moderate scope required", c.name)
+		c.reject(clientMsgID, errorForbidden, "moderate scope required")
+		return
+	}
+
+	req.Room = c.currentRoom()
+	if _, err := c.hub.Moderate(req, c.name); err != nil {
+		log.Printf("[ERROR] Moderation command from %s failed: %v", c.name, err)
+		c.reject(clientMsgID, errorCode(err), err.Error())
+		return
+	}
+	c.acknowledge(clientMsgID)
+}
+
+// handleGetSanctions handles GET /api/moderation
+func handleGetSanctions(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, SanctionsResponse{Sanctions: hub.Moderation().List()})
+}
+
+// handleModerate handles POST /api/moderation
+func handleModerate(hub *Hub, auth *Authenticator, w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	result, err := hub.Moderate(req, principal.Subject)
+	if err != nil {
+		switch errorCode(err) {
+		case errorNotFound:
+			writeError(w, http.StatusNotFound, err.Error())
+		case errorInternal:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		default:
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleLiftSanction handles DELETE /api/moderation/{id}
+func handleLiftSanction(hub *Hub, auth *Authenticator, w http.ResponseWriter, r *http.Request) {
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	id := r.PathValue("id")
+	if _, err := hub.LiftSanction(id, principal.Subject); err != nil {
+		if errors.Is(err, errSanctionNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("[ERROR] Failed to lift sanction: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to lift sanction")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "lifted", "id": id})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+)
+
+// Delivery scopes of custom message types
+const (
+	deliveryRoom    = "room"    // Everyone in the sender's room
+	deliverySender  = "sender"  // Only the sender
+	deliveryTargets = "targets" // The users listed in targets and the sender
+)
+
+const (
+	defaultPayloadSize = 4096 // Default maximum payload size of a custom message in bytes
+	maxMessageTargets  = 32
+)
+
+var messageTypeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// reservedMessageTypes are the built-in message types, which custom types
+// must not replace
+var reservedMessageTypes = map[string]bool{
+	"chat": true, "whisper": true, "dm": true, "edit": true, "delete": true,
+	"reaction": true, "typing": true, "hello": true, "user_event": true,
+	"system": true, "history": true, "chat_updated": true, "chat_deleted": true,
+	"reaction_update": true, "roster": true, "ack": true, "error": true,
+	"moderate": true, "review": true, "pending": true, "pending_queue": true,
+	"pending_reviewed": true,
+}
+
+// MessageType defines an application message type routed by the hub
+type MessageType struct {
+	Name      string          `json:"name"`
+	Scope     string          `json:"scope"`             // "room", "sender" or "targets"
+	Persist   bool            `json:"persist,omitempty"` // Store the messages in the room history
+	MaxSize   int             `json:"maxSize,omitempty"` // Maximum payload size in bytes
+	RawSchema json.RawMessage `json:"schema,omitempty"`  // JSON Schema of the payload
+
+	schema *Schema
+}
+
+// CustomData represents a message of a custom type
+type CustomData struct {
+	From    string          `json:"from"`
+	FromId  string          `json:"fromId"`
+	Targets []string        `json:"targets,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// loadMessageTypes reads custom message type definitions from a JSON file
+func loadMessageTypes(path string) (map[string]*MessageType, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message type file: %w", err)
+	}
+
+	var definitions []*MessageType
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return nil, fmt.Errorf("failed to parse message type file: %w", err)
+	}
+
+	types := make(map[string]*MessageType, len(definitions))
+	for _, definition := range definitions {
+		if err := definition.compile(); err != nil {
+			return nil, fmt.Errorf("message type %q: %w", definition.Name, err)
+		}
+		if _, exists := types[definition.Name]; exists {
+			return nil, fmt.Errorf("message type %q is defined twice", definition.Name)
+		}
+		types[definition.Name] = definition
+	}
+	return types, nil
+}
+
+// compile checks the definition and parses its schema
+func (t *MessageType) compile() error {
+	if !messageTypeNamePattern.MatchString(t.Name) {
+		return errors.New("name must be 1-32 lowercase letters, digits or underscores, starting with a letter")
+	}
+	if reservedMessageTypes[t.Name] {
+		return errors.New("name is reserved for a built-in message type")
+	}
+	switch t.Scope {
+	case deliveryRoom, deliverySender, deliveryTargets:
+	default:
+		return errors.New("scope must be room, sender or targets")
+	}
+	if t.MaxSize < 0 || t.MaxSize > maxMessageSize {
+		return fmt.Errorf("maxSize must be between 0 and %d", maxMessageSize)
+	}
+	if t.MaxSize == 0 {
+		t.MaxSize = defaultPayloadSize
+	}
+	if t.RawSchema != nil {
+		schema, err := parseSchema(t.RawSchema)
+		if err != nil {
+			return fmt.Errorf("invalid schema: %w", err)
+		}
+		t.schema = schema
+	}
+	return nil
+}
+
+// validate checks a client message of this type
+func (t *MessageType) validate(msg ClientMessage) error {
+	if len(msg.Payload) > t.MaxSize {
+		return newClientError(errorTooLong, "payload must be at most %d bytes", t.MaxSize)
+	}
+	if t.Scope == deliveryTargets {
+		if len(msg.Targets) == 0 || len(msg.Targets) > maxMessageTargets {
+			return fmt.Errorf("%s requires 1 to %d targets", t.Name, maxMessageTargets)
+		}
+	} else if len(msg.Targets) > 0 {
+		return fmt.Errorf("%s does not take targets", t.Name)
+	}
+	for _, name := range msg.Targets {
+		if name == "" || validateChars(name) != nil {
+			return errors.New("invalid target name")
+		}
+	}
+	if t.schema == nil {
+		return nil
+	}
+	payload := msg.Payload
+	if payload == nil {
+		payload = json.RawMessage("null")
+	}
+	return t.schema.Validate(payload)
+}
+
+// recipients returns the users a message of this type is delivered to, nil
+// for the whole room
+func (t *MessageType) recipients(data CustomData) []string {
+	switch t.Scope {
+	case deliverySender:
+		return []string{data.From}
+	case deliveryTargets:
+		recipients := make([]string, 0, len(data.Targets)+1)
+		for _, name := range data.Targets {
+			if !slices.Contains(recipients, name) {
+				recipients = append(recipients, name)
+			}
+		}
+		if !slices.Contains(recipients, data.From) {
+			recipients = append(recipients, data.From)
+		}
+		return recipients
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// Limits for structured chat payloads
+const (
+	defaultMetadataSize    = 4096 // Default maximum size of the metadata object in bytes
+	maxAttachments         = 8
+	maxAttachmentURLLength = 2048
+	maxAttachmentAltLength = 512
+)
+
+var mimeTypePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*$`)
+
+// Attachment is a file or link sent along with a chat message
+type Attachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mimeType"`      // e.g. "image/png" or "audio/mpeg"
+	Alt      string `json:"alt,omitempty"` // Text alternative of the attachment
+}
+
+// validate checks an attachment against the attachment schema
+func (a Attachment) validate() error {
+	parsed, err := url.Parse(a.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("attachment url must be an http or https URL")
+	}
+	if len(a.URL) > maxAttachmentURLLength {
+		return newClientError(errorTooLong, "attachment url must be at most %d bytes", maxAttachmentURLLength)
+	}
+	if !mimeTypePattern.MatchString(a.MimeType) {
+		return errors.New("attachment mimeType must be a MIME type such as image/png")
+	}
+	if len(a.Alt) > maxAttachmentAltLength {
+		return newClientError(errorTooLong, "attachment alt must be at most %d bytes", maxAttachmentAltLength)
+	}
+	if validateChars(a.Alt) != nil {
+		return newClientError(errorInvalidChars, "attachment alt must not contain control characters")
+	}
+	return nil
+}
+
+// validatePayload checks the metadata and attachments of a chat message
+func validatePayload(metadata json.RawMessage, attachments []Attachment) error {
+	if metadata != nil {
+		trimmed := bytes.TrimSpace(metadata)
+		if len(trimmed) == 0 || trimmed[0] != '{' {
+			return errors.New("metadata must be a JSON object")
+		}
+	}
+	if len(attachments) > maxAttachments {
+		return fmt.Errorf("at most %d attachments are allowed", maxAttachments)
+	}
+	for _, attachment := range attachments {
+		if err := attachment.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// Limits for profile fields
+const (
+	maxDisplayNameLength = 64
+	maxAvatarURLLength   = 512
+	maxRoleLength        = 32
+	maxStatusLength      = 128
+)
+
+var profileColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Profile holds how a user is presented to others
+type Profile struct {
+	DisplayName string `json:"displayName,omitempty"`
+	AvatarUrl   string `json:"avatarUrl,omitempty"`
+	Color       string `json:"color,omitempty"` // "#rgb" or "#rrggbb"
+	Role        string `json:"role,omitempty"`  // Role label such as "host", "guest AI" or "viewer"
+	Status      string `json:"status,omitempty"`
+}
+
+// ProfileUpdate holds the profile fields to change, nil fields are left
+// unchanged and empty strings clear a field
+type ProfileUpdate struct {
+	DisplayName *string `json:"displayName,omitempty"`
+	AvatarUrl   *string `json:"avatarUrl,omitempty"`
+	Color       *string `json:"color,omitempty"`
+	Role        *string `json:"role,omitempty"`
+	Status      *string `json:"status,omitempty"`
+}
+
+// apply returns a copy of profile with the update applied
+func (u ProfileUpdate) apply(profile Profile) Profile {
+	if u.DisplayName != nil {
+		profile.DisplayName = *u.DisplayName
+	}
+	if u.AvatarUrl != nil {
+		profile.AvatarUrl = *u.AvatarUrl
+	}
+	if u.Color != nil {
+		profile.Color = *u.Color
+	}
+	if u.Role != nil {
+		profile.Role = *u.Role
+	}
+	if u.Status != nil {
+		profile.Status = *u.Status
+	}
+	return profile
+}
+
+// validate checks the fields of a profile update
+func (u ProfileUpdate) validate() error {
+	if err := validateProfileText("displayName", u.DisplayName, maxDisplayNameLength); err != nil {
+		return err
+	}
+	if err := validateProfileText("role", u.Role, maxRoleLength); err != nil {
+		return err
+	}
+	if err := validateProfileText("status", u.Status, maxStatusLength); err != nil {
+		return err
+	}
+	if u.AvatarUrl != nil && *u.AvatarUrl != "" {
+		parsed, err := url.Parse(*u.AvatarUrl)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.New("avatarUrl must be an http or https URL")
+		}
+		if len(*u.AvatarUrl) > maxAvatarURLLength {
+			return newClientError(errorTooLong, "avatarUrl must be at most %d bytes", maxAvatarURLLength)
+		}
+	}
+	if u.Color != nil && *u.Color != "" && !profileColorPattern.MatchString(*u.Color) {
+		return errors.New("color must be #rgb or #rrggbb")
+	}
+	return nil
+}
+
+// allowedFor checks that an update leaves the display name of a client alone
+// when a JWT binds its name, so verified users cannot be presented under
+// another name. Clearing the display name or setting it to the bound name is allowed
+func (u ProfileUpdate) allowedFor(principal *Principal) error {
+	if principal.Name == "" || u.DisplayName == nil || *u.DisplayName == "" || *u.DisplayName == principal.Name {
+		return nil
+	}
+	return newClientError(errorForbidden, "displayName cannot be changed when a JWT binds the name")
+}
+
+// validateProfileText checks the length and characters of a text field
+func validateProfileText(field string, value *string, maxLength int) error {
+	if value == nil {
+		return nil
+	}
+	if len(*value) > maxLength {
+		return newClientError(errorTooLong, "%s must be at most %d bytes", field, maxLength)
+	}
+	if validateChars(*value) != nil {
+		return newClientError(errorInvalidChars, "%s must not contain control characters", field)
+	}
+	return nil
+}
+
+// profileFromQuery reads the profile fields given as connection parameters
+func profileFromQuery(r *http.Request) ProfileUpdate {
+	params := r.URL.Query()
+	field := func(key string) *string {
+		if !params.Has(key) {
+			return nil
+		}
+		value := params.Get(key)
+		return &value
+	}
+	return ProfileUpdate{
+		DisplayName: field("displayName"),
+		AvatarUrl:   field("avatarUrl"),
+		Color:       field("color"),
+		Role:        field("role"),
+		Status:      field("status"),
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions taken when a client exceeds a rate limit
+const (
+	rateActionDrop       = "drop"       // Drop the message silently
+	rateActionDelay      = "delay"      // Hold the message until the limit allows it, up to maxDelay
+	rateActionError      = "error"      // Drop the message and send a rate_limited error
+	rateActionDisconnect = "disconnect" // Close the connection
+)
+
+const (
+	defaultRateMaxDelay = 5.0  // Seconds a message may be delayed by default
+	maxRateMaxDelay     = 30.0 // Delays must stay well below pongWait
+	rateSweepInterval   = time.Minute
+)
+
+// RateLimit allows Rate messages per second with bursts of up to Burst
+// messages. A rate of 0 disables the limit
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst,omitempty"` // Defaults to the rate rounded up
+}
+
+// RatePolicy holds the limits applied to a client. Unset fields of a role
+// policy inherit the default policy
+type RatePolicy struct {
+	Action   string     `json:"action,omitempty"`   // "drop", "delay", "error" (default) or "disconnect"
+	MaxDelay *float64   `json:"maxDelay,omitempty"` // Longest delay in seconds for the delay action
+	Session  *RateLimit `json:"session,omitempty"`  // Per connection
+	Name     *RateLimit `json:"name,omitempty"`     // Per user name across connections and rooms
+	IP       *RateLimit `json:"ip,omitempty"`       // Per client IP address
+	Room     *RateLimit `json:"room,omitempty"`     // Per room, shared by its members
+}
+
+// RateLimitConfig is the content of the rate limit configuration file
+type RateLimitConfig struct {
+	RatePolicy
+	Roles map[string]RatePolicy `json:"roles,omitempty"` // Overrides for principals with the role
+}
+
+// merge returns the policy with the fields set in override replaced
+func (p RatePolicy) merge(override RatePolicy) RatePolicy {
+	if override.Action != "" {
+		p.Action = override.Action
+	}
+	if override.MaxDelay != nil {
+		p.MaxDelay = override.MaxDelay
+	}
+	if override.Session != nil {
+		p.Session = override.Session
+	}
+	if override.Name != nil {
+		p.Name = override.Name
+	}
+	if override.IP != nil {
+		p.IP = override.IP
+	}
+	if override.Room != nil {
+		p.Room = override.Room
+	}
+	return p
+}
+
+// validate checks the fields of a policy
+func (p RatePolicy) validate() error {
+	switch p.Action {
+	case "", rateActionDrop, rateActionDelay, rateActionError, rateActionDisconnect:
+	default:
+		return fmt.Errorf("action must be drop, delay, error or disconnect")
+	}
+	if p.MaxDelay != nil && (*p.MaxDelay < 0 || *p.MaxDelay > maxRateMaxDelay) {
+		return fmt.Errorf("maxDelay must be between 0 and %v seconds", maxRateMaxDelay)
+	}
+	for kind, limit := range map[string]*RateLimit{"session": p.Session, "name": p.Name, "ip": p.IP, "room": p.Room} {
+		if limit == nil {
+			continue
+		}
+		if limit.Rate < 0 || math.IsInf(limit.Rate, 0) || math.IsNaN(limit.Rate) || limit.Burst < 0 {
+			return fmt.Errorf("%s limit must have a non-negative rate and burst", kind)
+		}
+	}
+	return nil
+}
+
+// loadRateLimitConfig reads a rate limit configuration file
+func loadRateLimitConfig(path string) (RateLimitConfig, error) {
+	var config RateLimitConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read rate limit file: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse rate limit file: %w", err)
+	}
+	return config, nil
+}
+
+// parseRateLimit parses a limit given as "rate:burst" or "rate"
+func parseRateLimit(value string) (*RateLimit, error) {
+	rate, burst, hasBurst := strings.Cut(value, ":")
+	limit := &RateLimit{}
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+		return nil, fmt.Errorf("invalid rate %q", rate)
+	}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil {
+			return nil, fmt.Errorf("invalid burst %q", burst)
+		}
+	}
+	return limit, nil
+}
+
+// tokenBucket holds the tokens of one limited key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// refill adds the tokens earned since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// bucketKey identifies a bucket. Buckets of different policies are kept apart
+// so a role with a higher room limit does not share the room bucket of others
+type bucketKey struct {
+	policy string
+	kind   string
+	key    string
+}
+
+// RateLimiter applies token bucket limits to client messages
+type RateLimiter struct {
+	mu        sync.Mutex
+	defaults  RatePolicy
+	roles     map[string]RatePolicy // Merged with the defaults
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a rate limiter from a validated configuration
+func NewRateLimiter(config RateLimitConfig) (*RateLimiter, error) {
+	if err := config.RatePolicy.validate(); err != nil {
+		return nil, err
+	}
+	l := &RateLimiter{
+		defaults:  RatePolicy{Action: rateActionError}.merge(config.RatePolicy),
+		roles:     make(map[string]RatePolicy, len(config.Roles)),
+		buckets:   make(map[bucketKey]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+	for role, policy := range config.Roles {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("role %s: %w", role, err)
+		}
+		l.roles[role] = l.defaults.merge(policy)
+	}
+	return l, nil
+}
+
+// policy returns the policy of the first role of the principal that has
+// one, or the default policy
+func (l *RateLimiter) policy(principal *Principal) (string, RatePolicy) {
+	for _, role := range principal.Roles {
+		if policy, ok := l.roles[role]; ok {
+			return role, policy
+		}
+	}
+	return "", l.defaults
+}
+
+// reserve takes a token from every bucket that applies to a message of the
+// client in room. It returns how long the message must wait, the action of
+// the client's policy, and false with the exceeded limit when the message
+// must not be sent
+func (l *RateLimiter) reserve(c *Client, room string) (time.Duration, string, string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	role, policy := l.policy(c.principal)
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateSweepInterval {
+		l.sweep(now)
+	}
+
+	maxWait := 0.0
+	if policy.Action == rateActionDelay {
+		maxWait = defaultRateMaxDelay
+		if policy.MaxDelay != nil {
+			maxWait = *policy.MaxDelay
+		}
+	}
+
+	limits := []struct {
+		kind  string
+		key   string
+		limit *RateLimit
+	}{
+		{"session", c.id, policy.Session},
+		{"name", c.name, policy.Name},
+		{"ip", c.ip, policy.IP},
+		{"room", room, policy.Room},
+	}
+
+	// Check every bucket before taking tokens so a rejected message does not
+	// use up the budget of the other limits
+	var buckets []*tokenBucket
+	wait := 0.0
+	for _, entry := range limits {
+		if entry.limit == nil || entry.limit.Rate <= 0 || entry.key == "" {
+			continue
+		}
+		key := bucketKey{policy: role, kind: entry.kind, key: entry.key}
+		burst := float64(entry.limit.Burst)
+		if burst == 0 {
+			burst = math.Ceil(entry.limit.Rate)
+		}
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: burst, last: now}
+			l.buckets[key] = bucket
+		}
+		bucket.rate = entry.limit.Rate
+		bucket.burst = burst
+		bucket.refill(now)
+
+		if need := (1 - bucket.tokens) / bucket.rate; need > wait {
+			wait = need
+		}
+		if wait > maxWait {
+			return 0, policy.Action, entry.kind, false
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	// Delayed messages take their token now, leaving the bucket in debt
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return time.Duration(wait * float64(time.Second)), policy.Action, "", true
+}
+
+// sweep drops buckets that have refilled completely, caller must hold the lock
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// allowMessage applies the rate limits to a message of the client and
+// reports whether it may be sent. Delayed messages return after the delay
+func (c *Client) allowMessage(clientMsgID string) bool {
+	limiter := c.hub.RateLimiter()
+	if limiter == nil {
+		return true
+	}
+
+	room := c.currentRoom()
+	wait, action, kind, ok := limiter.reserve(c, room)
+	if ok {
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		return true
+	}
+
+	log.Printf("[WARN] Rate limit exceeded: name=%s, room=%s, limit=%s, action=%s", c.name, room, kind, action)
+	switch action {
+	case rateActionError, rateActionDelay:
+		c.reject(clientMsgID, errorRateLimited, fmt.Sprintf("%s rate limit exceeded", kind))
+	case rateActionDisconnect:
+		c.hub.Disconnect(func(other *Client) bool { return other == c }, closeRateLimited, "rate limit exceeded")
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client of a request, taken from
+// X-Forwarded-For or X-Real-IP when the server runs behind a trusted proxy.
+// Only the last X-Forwarded-For entry is used, as it is the one the proxy
+// appended; earlier entries come from the client and can be forged
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			forwarded := values[len(values)-1]
+			if i := strings.LastIndex(forwarded, ","); i >= 0 {
+				forwarded = forwarded[i+1:]
+			}
+			if forwarded = strings.TrimSpace(forwarded); forwarded != "" {
+				return forwarded
+			}
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		tokens  float64
+		rate    float64
+		burst   float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"no time passed", 2, 1, 3, 0, 2},
+		{"partial refill", 0, 2, 5, 500 * time.Millisecond, 1},
+		{"capped at burst", 4, 2, 5, 10 * time.Second, 5},
+		{"debt is repaid first", -1.5, 1, 3, time.Second, -0.5},
+		{"debt refills up to burst", -2, 1, 3, time.Minute, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := &tokenBucket{tokens: tt.tokens, last: start, rate: tt.rate, burst: tt.burst}
+			now := start.Add(tt.elapsed)
+			bucket.refill(now)
+			if math.Abs(bucket.tokens-tt.want) > 1e-9 {
+				t.Errorf("refill() tokens = %v, want %v", bucket.tokens, tt.want)
+			}
+			if !bucket.last.Equal(now) {
+				t.Errorf("refill() last = %v, want %v", bucket.last, now)
+			}
+		})
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	maxDelay := 1.0
+	type result struct {
+		ok   bool
+		wait time.Duration
+		kind string
+	}
+	tests := []struct {
+		name   string
+		policy RatePolicy
+		want   []result
+	}{
+		{
+			name:   "no limits",
+			policy: RatePolicy{},
+			want:   []result{{ok: true}, {ok: true}, {ok: true}},
+		},
+		{
+			name:   "zero rate disables the limit",
+			policy: RatePolicy{Session: &RateLimit{Rate: 0, Burst: 1}},
+			want:   []result{{ok: true}, {ok: true}},
+		},
+		{
+			name:   "burst then rejected",
+			policy: RatePolicy{Session: &RateLimit{Rate: 1, Burst: 2}},
+			want:   []result{{ok: true}, {ok: true}, {kind: "session"}, {kind: "session"}},
+		},
+		{
+			name:   "burst defaults to the rate rounded up",
+			policy: RatePolicy{Name: &RateLimit{Rate: 1.5}},
+			want:   []result{{ok: true}, {ok: true}, {kind: "name"}},
+		},
+		{
+			name:   "strictest limit wins",
+			policy: RatePolicy{Session: &RateLimit{Rate: 10, Burst: 10}, Room: &RateLimit{Rate: 1, Burst: 1}},
+			want:   []result{{ok: true}, {kind: "room"}},
+		},
+		{
+			name:   "delay builds up debt until the longest delay",
+			policy: RatePolicy{Action: rateActionDelay, MaxDelay: &maxDelay, IP: &RateLimit{Rate: 2, Burst: 1}},
+			want: []result{
+				{ok: true},
+				{ok: true, wait: 500 * time.Millisecond},
+				{ok: true, wait: time.Second},
+				{kind: "ip"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, err := NewRateLimiter(RateLimitConfig{RatePolicy: tt.policy})
+			if err != nil {
+				t.Fatalf("NewRateLimiter() error = %v", err)
+			}
+			client := &Client{id: "session-1", name: "alice", ip: "192.0.2.1", principal: anonymousPrincipal}
+			for i, want := range tt.want {
+				wait, _, kind, ok := limiter.reserve(client, "lobby")
+				if ok != want.ok || kind != want.kind {
+					t.Fatalf("message %d: reserve() = %v, %q, want %v, %q", i, ok, kind, want.ok, want.kind)
+				}
+				// Tokens keep refilling while the test runs
+				if diff := want.wait - wait; diff < 0 || diff > 50*time.Millisecond {
+					t.Errorf("message %d: reserve() wait = %v, want %v", i, wait, want.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterReserveKeepsOtherBudgets(t *testing.T) {
+	limiter, err := NewRateLimiter(RateLimitConfig{RatePolicy: RatePolicy{
+		Session: &RateLimit{Rate: 0.001, Burst: 5},
+		Room:    &RateLimit{Rate: 0.001, Burst: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{id: "session-1", name: "alice", principal: anonymousPrincipal}
+	for i := 0; i < 3; i++ {
+		limiter.reserve(client, "lobby")
+	}
+
+	// Only the first message was sent, the rejected ones took no session token
+	session := limiter.buckets[bucketKey{kind: "session", key: "session-1"}]
+	if session == nil || math.Round(session.tokens) != 4 {
+		t.Fatalf("session bucket = %+v, want 4 tokens", session)
+	}
+
+	// Another room has its own bucket
+	if _, _, kind, ok := limiter.reserve(client, "stage"); !ok {
+		t.Errorf("reserve() in another room rejected by the %s limit", kind)
+	}
+}
+
+func TestRateLimiterRolePolicy(t *testing.T) {
+	limiter, err := NewRateLimiter(RateLimitConfig{
+		RatePolicy: RatePolicy{Room: &RateLimit{Rate: 0.001, Burst: 1}},
+		Roles:      map[string]RatePolicy{"host": {Room: &RateLimit{Rate: 0.001, Burst: 3}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := &Client{id: "session-1", name: "viewer", principal: &Principal{Subject: "viewer"}}
+	host := &Client{id: "session-2", name: "host", principal: &Principal{Subject: "host", Roles: []string{"guest", "host"}}}
+
+	if _, _, _, ok := limiter.reserve(viewer, "lobby"); !ok {
+		t.Fatal("first viewer message rejected")
+	}
+	if _, _, _, ok := limiter.reserve(viewer, "lobby"); ok {
+		t.Fatal("second viewer message allowed")
+	}
+	// The host role has its own room bucket, untouched by the viewer
+	for i := 0; i < 3; i++ {
+		if _, _, kind, ok := limiter.reserve(host, "lobby"); !ok {
+			t.Fatalf("host message %d rejected by the %s limit", i, kind)
+		}
+	}
+	if _, _, _, ok := limiter.reserve(host, "lobby"); ok {
+		t.Fatal("host message beyond the role burst allowed")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarded  []string
+		realIP     string
+		trustProxy bool
+		want       string
+	}{
+		{"remote address", nil, "", false, "198.51.100.7"},
+		{"headers ignored without a trusted proxy", []string{"192.0.2.1"}, "192.0.2.2", false, "198.51.100.7"},
+		{"single entry", []string{"192.0.2.1"}, "", true, "192.0.2.1"},
+		{"last entry", []string{"203.0.113.9, 192.0.2.1"}, "", true, "192.0.2.1"},
+		{"last header", []string{"203.0.113.9", "192.0.2.1"}, "", true, "192.0.2.1"},
+		{"spaces", []string{"203.0.113.9 ,  192.0.2.1 "}, "", true, "192.0.2.1"},
+		{"empty last entry", []string{"192.0.2.1,"}, "192.0.2.2", true, "192.0.2.2"},
+		{"real ip", nil, "192.0.2.2", true, "192.0.2.2"},
+		{"no headers", nil, "", true, "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.RemoteAddr = "198.51.100.7:51234"
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r, tt.trustProxy); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Review actions for pending messages
+const (
+	reviewApprove = "approve" // Deliver the message as sent
+	reviewEdit    = "edit"    // Deliver the message with the moderator's text
+	reviewReject  = "reject"  // Drop the message and tell the sender
+)
+
+const (
+	maxPendingMessages   = 500 // Pending messages kept per room
+	moderatedRoomReason  = "moderated room"
+	defaultRejectMessage = "rejected by a moderator"
+)
+
+var errPendingNotFound = errors.New("pending message not found")
+
+// PendingMessage is a message waiting for a moderator to review it
+type PendingMessage struct {
+	ID      string           `json:"id"`
+	Reason  string           `json:"reason"` // "moderated room" or why a content filter held it
+	HeldAt  string           `json:"heldAt"`
+	Message WebSocketMessage `json:"message"` // The message as it will be delivered
+}
+
+// PendingQueueData lists the pending messages of a room
+type PendingQueueData struct {
+	Messages []PendingMessage `json:"messages"`
+}
+
+// PendingResponse lists the pending messages of a room
+type PendingResponse struct {
+	Room     string           `json:"room"`
+	Messages []PendingMessage `json:"messages"`
+}
+
+// ReviewedData tells moderators that a pending message was reviewed
+type ReviewedData struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	By     string `json:"by"`
+}
+
+// ReviewRequest approves, edits or rejects a pending message
+type ReviewRequest struct {
+	ID     string `json:"id,omitempty"`     // Pending message ID, taken from the path in the REST API
+	Action string `json:"action"`           // "approve", "edit" or "reject"
+	Text   string `json:"text,omitempty"`   // Replacement text for edit
+	Reason string `json:"reason,omitempty"` // Told to the sender on reject
+}
+
+// reviewChange asks the hub loop to apply a review
+type reviewChange struct {
+	room   string
+	by     string
+	req    ReviewRequest
+	result chan error
+}
+
+// validate checks the fields of a review request
+func (req ReviewRequest) validate() error {
+	if req.ID == "" {
+		return errors.New("review requires a pending message id")
+	}
+	switch req.Action {
+	case reviewApprove, reviewReject:
+	case reviewEdit:
+		if req.Text == "" {
+			return errors.New("edit requires a text")
+		}
+		if len(req.Text) > maxMessageLength {
+			return errMessageTooLong
+		}
+		if err := validateChars(req.Text); err != nil {
+			return err
+		}
+	default:
+		return errors.New("action must be approve, edit or reject")
+	}
+	if len(req.Reason) > maxModerationReasonLength {
+		return newClientError(errorTooLong, "reason must be at most %d bytes", maxModerationReasonLength)
+	}
+	return validateChars(req.Reason)
+}
+
+// needsReview returns the room whose review queue a client message must wait
+// in. Chat messages, whispers, direct messages and custom message types wait
+// when they are sent in a moderated room, direct messages also when the
+// recipient is in one. Moderators skip the queue
+func (h *Hub) needsReview(msg WebSocketMessage) (string, bool) {
+	if msg.origin == nil || msg.origin.principal.IsModerator() {
+		return "", false
+	}
+	switch data := msg.Data.(type) {
+	case ChatData:
+		if h.isModerated(msg.Room) {
+			return msg.Room, true
+		}
+		if msg.Type == "dm" {
+			return h.moderatedRoomOf(data.To)
+		}
+	case CustomData:
+		if h.isModerated(msg.Room) {
+			return msg.Room, true
+		}
+	}
+	return "", false
+}
+
+// moderatedRoomOf returns a moderated room that a connected user is in
+func (h *Hub) moderatedRoomOf(name string) (string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.clients {
+		if client.name != name {
+			continue
+		}
+		if config, ok := h.predefinedRooms[client.room]; ok && config.Moderated {
+			return client.room, true
+		}
+	}
+	return "", false
+}
+
+// isModerated reports whether messages of a room wait for review
+func (h *Hub) isModerated(room string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	config, ok := h.predefinedRooms[room]
+	return ok && config.Moderated
+}
+
+// enqueue adds a message to the review queue of a room and tells the sender
+// and the moderators of the room, must be called from the hub loop
+func (h *Hub) enqueue(room string, msg WebSocketMessage, reason string) {
+	pending := &PendingMessage{
+		ID:      generateID("pending"),
+		Reason:  reason,
+		HeldAt:  time.Now().UTC().Format(time.RFC3339),
+		Message: msg,
+	}
+
+	h.mu.Lock()
+	if len(h.pending[room]) >= maxPendingMessages {
+		h.mu.Unlock()
+		log.Printf("[WARN] Review queue of room %s is full, rejecting message", room)
+		h.rejectMessage(msg, errorRateLimited, "review queue is full")
+		return
+	}
+	h.pending[room] = append(h.pending[room], pending)
+	h.mu.Unlock()
+
+	log.Printf("[INFO] Message held for review: id=%s, room=%s, reason=%s", pending.ID, room, reason)
+	if msg.clientMsgID != "" {
+		h.reply(msg.origin, WebSocketMessage{
+			Type:      "ack",
+			Room:      msg.Room,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Data:      AckData{ClientMsgID: msg.clientMsgID, Held: true},
+		})
+	}
+	h.sendToModerators(room, WebSocketMessage{
+		Type:      "pending",
+		Room:      room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      *pending,
+	})
+}
+
+// Review applies a review to a pending message of a room on behalf of by
+func (h *Hub) Review(room, by string, req ReviewRequest) error {
+	if err := req.validate(); err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	h.reviews <- reviewChange{room: room, by: by, req: req, result: result}
+	return <-result
+}
+
+// review applies a review request, must be called from the hub loop
+func (h *Hub) review(change reviewChange) error {
+	h.mu.Lock()
+	queue := h.pending[change.room]
+	index := slices.IndexFunc(queue, func(p *PendingMessage) bool { return p.ID == change.req.ID })
+	if index < 0 {
+		h.mu.Unlock()
+		return fmt.Errorf("%w: %s", errPendingNotFound, change.req.ID)
+	}
+	pending := queue[index]
+	if _, ok := pending.Message.Data.(ChatData); !ok && change.req.Action == reviewEdit {
+		h.mu.Unlock()
+		return errors.New("only chat messages, whispers and direct messages can be edited")
+	}
+	if queue = slices.Delete(queue, index, index+1); len(queue) == 0 {
+		delete(h.pending, change.room)
+	} else {
+		h.pending[change.room] = queue
+	}
+	h.mu.Unlock()
+
+	msg := pending.Message
+	if change.req.Action == reviewReject {
+		reason := change.req.Reason
+		if reason == "" {
+			reason = defaultRejectMessage
+		}
+		h.rejectMessage(msg, errorRejected, reason)
+	} else {
+		if data, ok := msg.Data.(ChatData); ok && change.req.Action == reviewEdit {
+			data.Text = change.req.Text
+			data.Mention = parseMentions(data.Text)
+			msg.Data = data
+		}
+		// Approved messages take their place in the room at approval time
+		msg.Timestamp = time.Now().UTC().Format(time.RFC3339)
+		msg.reviewed = true
+		h.route(msg)
+	}
+
+	log.Printf("[INFO] Pending message reviewed: id=%s, room=%s, action=%s, by=%s", pending.ID, change.room, change.req.Action, change.by)
+	h.sendToModerators(change.room, WebSocketMessage{
+		Type:      "pending_reviewed",
+		Room:      change.room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      ReviewedData{ID: pending.ID, Action: change.req.Action, By: change.by},
+	})
+	return nil
+}
+
+// PendingMessages returns the pending messages of a room, oldest first
+func (h *Hub) PendingMessages(room string) []PendingMessage {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	messages := make([]PendingMessage, 0, len(h.pending[room]))
+	for _, pending := range h.pending[room] {
+		messages = append(messages, *pending)
+	}
+	return messages
+}
+
+// sendPendingQueue sends the review queue of its room to a moderator that joined
+func (h *Hub) sendPendingQueue(client *Client) {
+	if !client.principal.IsModerator() {
+		return
+	}
+	messages := h.PendingMessages(client.room)
+	if len(messages) == 0 {
+		return
+	}
+	data, err := json.Marshal(WebSocketMessage{
+		Type:      "pending_queue",
+		Room:      client.room,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      PendingQueueData{Messages: messages},
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal pending queue: %v", err)
+		return
+	}
+
+	select {
+	case client.send <- data:
+	default:
+		log.Printf("[WARN] Send buffer full, dropping pending queue for client %s", client.name)
+	}
+}
+
+// sendToModerators sends a message to the moderators in a room
+func (h *Hub) sendToModerators(room string, msg WebSocketMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal %s: %v", msg.Type, err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.rooms[room] {
+		if client.principal.IsModerator() {
+			client.trySend(data, msg.Type)
+		}
+	}
+}
+
+// review applies a review command of a moderator client to its room
+func (c *Client) review(req ReviewRequest, clientMsgID string) {
+	if !c.principal.IsModerator() {
+		log.Printf("[WARN] Dropped review from %s: moderate scope required", c.name)
+		c.reject(clientMsgID, errorForbidden, "moderate scope required")
+		return
+	}
+
+	if err := c.hub.Review(c.currentRoom(), c.name, req); err != nil {
+		log.Printf("[ERROR] Review from %s failed: %v", c.name, err)
+		code := errorCode(err)
+		if errors.Is(err, errPendingNotFound) {
+			code = errorNotFound
+		}
+		c.reject(clientMsgID, code, err.Error())
+		return
+	}
+	c.acknowledge(clientMsgID)
+}
+
+// handleGetPending handles GET /api/rooms/{name}/pending
+func handleGetPending(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("name")
+	writeJSON(w, http.StatusOK, PendingResponse{Room: room, Messages: hub.PendingMessages(room)})
+}
+
+// handleReview handles POST /api/rooms/{name}/pending/{id}
+func handleReview(hub *Hub, auth *Authenticator, w http.ResponseWriter, r *http.Request) {
+	var req ReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	req.ID = r.PathValue("id")
+
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := hub.Review(r.PathValue("name"), principal.Subject, req); err != nil {
+		if errors.Is(err, errPendingNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reviewed", "id": req.ID, "action": req.Action})
+}
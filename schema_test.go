@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestParseSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{"empty", `{}`, false},
+		{"type list", `{"type": ["string", "null"]}`, false},
+		{"nested", `{"type": "object", "properties": {"tags": {"type": "array", "items": {"type": "string", "pattern": "^[a-z]+$"}}}}`, false},
+		{"unsupported keyword", `{"type": "string", "format": "email"}`, true},
+		{"unsupported nested keyword", `{"properties": {"a": {"oneOf": []}}}`, true},
+		{"unknown type", `{"type": "float"}`, true},
+		{"invalid type", `{"type": 1}`, true},
+		{"invalid pattern", `{"pattern": "("}`, true},
+		{"invalid items", `{"items": {"type": "float"}}`, true},
+		{"null property", `{"properties": {"a": null}}`, true},
+		{"not json", `{`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSchema([]byte(tt.schema))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSchema() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		payload string
+		wantErr bool
+	}{
+		{"type string", `{"type": "string"}`, `"hi"`, false},
+		{"type string mismatch", `{"type": "string"}`, `1`, true},
+		{"type list", `{"type": ["string", "null"]}`, `null`, false},
+		{"type list mismatch", `{"type": ["string", "null"]}`, `true`, true},
+		{"type integer", `{"type": "integer"}`, `3.0`, false},
+		{"type integer fraction", `{"type": "integer"}`, `3.5`, true},
+		{"type number", `{"type": "number"}`, `3.5`, false},
+		{"type boolean", `{"type": "boolean"}`, `false`, false},
+		{"type array", `{"type": "array"}`, `{}`, true},
+		{"enum", `{"enum": ["happy", "sad", 1]}`, `"sad"`, false},
+		{"enum number", `{"enum": ["happy", "sad", 1]}`, `1`, false},
+		{"enum mismatch", `{"enum": ["happy", "sad"]}`, `"angry"`, true},
+		{"const", `{"const": {"a": [1, 2]}}`, `{"a": [1, 2]}`, false},
+		{"const mismatch", `{"const": {"a": [1, 2]}}`, `{"a": [2, 1]}`, true},
+		{"required", `{"type": "object", "required": ["emotion"]}`, `{"emotion": "happy"}`, false},
+		{"required missing", `{"type": "object", "required": ["emotion"]}`, `{}`, true},
+		{"property", `{"properties": {"level": {"type": "integer"}}}`, `{"level": 2}`, false},
+		{"property mismatch", `{"properties": {"level": {"type": "integer"}}}`, `{"level": "high"}`, true},
+		{"additional properties allowed", `{"properties": {"a": {}}}`, `{"a": 1, "b": 2}`, false},
+		{"additional properties denied", `{"properties": {"a": {}}, "additionalProperties": false}`, `{"a": 1, "b": 2}`, true},
+		{"min items", `{"minItems": 2}`, `[1]`, true},
+		{"max items", `{"maxItems": 2}`, `[1, 2]`, false},
+		{"max items exceeded", `{"maxItems": 2}`, `[1, 2, 3]`, true},
+		{"items", `{"items": {"type": "string"}}`, `["a", "b"]`, false},
+		{"items mismatch", `{"items": {"type": "string"}}`, `["a", 2]`, true},
+		{"min length counts characters", `{"minLength": 3}`, `"あいう"`, false},
+		{"min length", `{"minLength": 3}`, `"ab"`, true},
+		{"max length counts characters", `{"maxLength": 3}`, `"あいう"`, false},
+		{"max length", `{"maxLength": 3}`, `"abcd"`, true},
+		{"pattern", `{"pattern": "^#[0-9a-f]{6}$"}`, `"#ff00aa"`, false},
+		{"pattern mismatch", `{"pattern": "^#[0-9a-f]{6}$"}`, `"red"`, true},
+		{"minimum", `{"minimum": 0}`, `0`, false},
+		{"below minimum", `{"minimum": 0}`, `-0.5`, true},
+		{"maximum", `{"maximum": 1}`, `1`, false},
+		{"above maximum", `{"maximum": 1}`, `1.5`, true},
+		{"keywords of other types are ignored", `{"minLength": 3, "maximum": 1}`, `[1, 2]`, false},
+		{"trailing data", `{}`, `1 2`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := parseSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatalf("parseSchema() error = %v", err)
+			}
+			err = schema.Validate([]byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%s) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			}
+		})
+	}
+}
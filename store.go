@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// StoredMessage represents a routed message as retained by a MessageStore
+type StoredMessage struct {
+	ID        string          `json:"id"`
+	Seq       uint64          `json:"seq"`
+	Type      string          `json:"type"`
+	Room      string          `json:"room"`
+	Timestamp string          `json:"timestamp"`
+	From      string          `json:"from,omitempty"`
+	FromId    string          `json:"fromId,omitempty"`
+	To        []string        `json:"to,omitempty"` // Recipients of a private message
+	Data      json.RawMessage `json:"data"`
+	Revision  int             `json:"revision,omitempty"` // Number of edits
+	EditedAt  string          `json:"editedAt,omitempty"`
+	Deleted   bool            `json:"deleted,omitempty"` // Tombstone of a deleted message, its text is removed
+
+	// Users per reaction. The map is replaced, never modified, on updates
+	Reactions map[string][]string `json:"reactions,omitempty"`
+}
+
+// visibleTo reports whether a user may see the message
+func (m StoredMessage) visibleTo(name string) bool {
+	if len(m.To) == 0 {
+		return true
+	}
+	for _, to := range m.To {
+		if to == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MessageStore keeps the history of routed messages per room
+type MessageStore interface {
+	// Append stores a message and returns it with its per-room sequence number assigned
+	Append(msg StoredMessage) (StoredMessage, error)
+	// Recent returns up to n of the newest messages in a room, oldest first
+	Recent(room string, n int) ([]StoredMessage, error)
+	// Query returns a page of messages matching q, oldest first, and whether more exist
+	Query(q MessageQuery) ([]StoredMessage, bool, error)
+	// Get returns the message with the given ID in a room, if it is still retained
+	Get(room, id string) (StoredMessage, bool, error)
+	// Update replaces a retained message with the same room and ID
+	Update(msg StoredMessage) error
+	// DeleteRoom removes the history of a room
+	DeleteRoom(room string) error
+	// RenameRoom moves the history of a room to a new name
+	RenameRoom(from, to string) error
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// MessageQuery selects a page of stored messages in a room
+type MessageQuery struct {
+	Room   string
+	Before uint64 // Only messages with a smaller seq (0 = no bound)
+	After  uint64 // Only messages with a larger seq (0 = no bound)
+	Limit  int
+	From   string
+	FromId string
+	Type   string
+
+	// Private messages are only included for their recipients, or for
+	// everyone with Private set
+	Viewer  string
+	Private bool
+}
+
+// matches reports whether a message satisfies the query filters
+func (q MessageQuery) matches(msg StoredMessage) bool {
+	if q.Before != 0 && msg.Seq >= q.Before {
+		return false
+	}
+	if q.After != 0 && msg.Seq <= q.After {
+		return false
+	}
+	if q.From != "" && msg.From != q.From {
+		return false
+	}
+	if q.FromId != "" && msg.FromId != q.FromId {
+		return false
+	}
+	if q.Type != "" && msg.Type != q.Type {
+		return false
+	}
+	if !q.Private && len(msg.To) > 0 && (q.Viewer == "" || !msg.visibleTo(q.Viewer)) {
+		return false
+	}
+	return true
+}
+
+var (
+	errStoreClosed     = errors.New("message store is closed")
+	errMessageNotFound = errors.New("message not found")
+)
+
+// NewMessageStore creates the message store selected by backend
+func NewMessageStore(backend, path string, limit int) (MessageStore, error) {
+	switch backend {
+	case "memory":
+		return NewMemoryStore(limit), nil
+	case "file":
+		return NewFileStore(path, limit)
+	default:
+		return nil, fmt.Errorf("unknown history backend: %s", backend)
+	}
+}
+
+// messageRing is a fixed-size ring buffer of messages
+type messageRing struct {
+	buf   []StoredMessage
+	start int
+	size  int
+}
+
+func newMessageRing(capacity int) *messageRing {
+	return &messageRing{buf: make([]StoredMessage, capacity)}
+}
+
+func (r *messageRing) push(msg StoredMessage) {
+	if len(r.buf) == 0 {
+		return
+	}
+	if r.size < len(r.buf) {
+		r.buf[(r.start+r.size)%len(r.buf)] = msg
+		r.size++
+		return
+	}
+	// Overwrite the oldest message
+	r.buf[r.start] = msg
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// find returns the buffer index of the message with id, or -1
+func (r *messageRing) find(id string) int {
+	for i := 0; i < r.size; i++ {
+		index := (r.start + i) % len(r.buf)
+		if r.buf[index].ID == id {
+			return index
+		}
+	}
+	return -1
+}
+
+// last returns a copy of up to n of the newest messages, oldest first
+func (r *messageRing) last(n int) []StoredMessage {
+	if n > r.size || n < 0 {
+		n = r.size
+	}
+	messages := make([]StoredMessage, 0, n)
+	for i := r.size - n; i < r.size; i++ {
+		messages = append(messages, r.buf[(r.start+i)%len(r.buf)])
+	}
+	return messages
+}
+
+// MemoryStore keeps the newest messages of each room in a ring buffer
+type MemoryStore struct {
+	mu    sync.RWMutex
+	limit int
+	rooms map[string]*messageRing
+	seqs  map[string]uint64
+}
+
+// NewMemoryStore creates a store retaining up to limit messages per room
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{
+		limit: limit,
+		rooms: make(map[string]*messageRing),
+		seqs:  make(map[string]uint64),
+	}
+}
+
+func (s *MemoryStore) Append(msg StoredMessage) (StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seqs[msg.Room]++
+	msg.Seq = s.seqs[msg.Room]
+	s.put(msg)
+	return msg, nil
+}
+
+// put stores a message keeping its sequence number, caller must hold the lock
+func (s *MemoryStore) put(msg StoredMessage) {
+	if msg.Seq > s.seqs[msg.Room] {
+		s.seqs[msg.Room] = msg.Seq
+	}
+	ring, ok := s.rooms[msg.Room]
+	if !ok {
+		ring = newMessageRing(s.limit)
+		s.rooms[msg.Room] = ring
+	}
+	ring.push(msg)
+}
+
+func (s *MemoryStore) Recent(room string, n int) ([]StoredMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ring, ok := s.rooms[room]
+	if !ok {
+		return nil, nil
+	}
+	return ring.last(n), nil
+}
+
+func (s *MemoryStore) Query(q MessageQuery) ([]StoredMessage, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ring, ok := s.rooms[q.Room]
+	if !ok {
+		return []StoredMessage{}, false, nil
+	}
+
+	var matched []StoredMessage
+	for _, msg := range ring.last(-1) {
+		if q.matches(msg) {
+			matched = append(matched, msg)
+		}
+	}
+
+	if len(matched) <= q.Limit {
+		return append([]StoredMessage{}, matched...), false, nil
+	}
+	// Page forward from an after cursor, otherwise backward from the newest
+	if q.After != 0 {
+		return matched[:q.Limit], true, nil
+	}
+	return matched[len(matched)-q.Limit:], true, nil
+}
+
+func (s *MemoryStore) Get(room, id string) (StoredMessage, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ring, ok := s.rooms[room]
+	if !ok {
+		return StoredMessage{}, false, nil
+	}
+	index := ring.find(id)
+	if index < 0 {
+		return StoredMessage{}, false, nil
+	}
+	return ring.buf[index], true, nil
+}
+
+func (s *MemoryStore) Update(msg StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring, ok := s.rooms[msg.Room]
+	if !ok {
+		return errMessageNotFound
+	}
+	index := ring.find(msg.ID)
+	if index < 0 {
+		return errMessageNotFound
+	}
+	ring.buf[index] = msg
+	if msg.Deleted {
+		// Earlier edits of a deleted message must not give its text away
+		for i := 0; i < ring.size; i++ {
+			index := (ring.start + i) % len(ring.buf)
+			if redacted, ok := redactEdit(ring.buf[index], msg.ID); ok {
+				ring.buf[index] = redacted
+			}
+		}
+	}
+	return nil
+}
+
+// redactEdit returns a stored chat_updated event of the message with the
+// given ID without its text, and whether msg was such an event
+func redactEdit(msg StoredMessage, id string) (StoredMessage, bool) {
+	if msg.Type != "chat_updated" {
+		return msg, false
+	}
+	var data ChatUpdatedData
+	if err := json.Unmarshal(msg.Data, &data); err != nil || data.ID != id {
+		return msg, false
+	}
+	data.Text = ""
+	data.Mention = nil
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return msg, false
+	}
+	msg.Data = raw
+	return msg, true
+}
+
+// snapshot returns a copy of the messages of every room, oldest first within
+// each room
+func (s *MemoryStore) snapshot() []StoredMessage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []StoredMessage
+	for _, ring := range s.rooms {
+		messages = append(messages, ring.last(-1)...)
+	}
+	return messages
+}
+
+func (s *MemoryStore) DeleteRoom(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rooms, room)
+	delete(s.seqs, room)
+	return nil
+}
+
+func (s *MemoryStore) RenameRoom(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring, ok := s.rooms[from]
+	if !ok {
+		return nil
+	}
+	for i := range ring.buf {
+		ring.buf[i].Room = to
+	}
+	s.rooms[to] = ring
+	s.seqs[to] = s.seqs[from]
+	delete(s.rooms, from)
+	delete(s.seqs, from)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// fileEntry is a single line of the append-only history file
+type fileEntry struct {
+	Op      string         `json:"op"` // "append", "update", "delete_room" or "rename_room"
+	Message *StoredMessage `json:"message,omitempty"`
+	Room    string         `json:"room,omitempty"`
+	To      string         `json:"to,omitempty"`
+}
+
+// compactDelay batches the compactions of the history file after deletions
+const compactDelay = 5 * time.Second
+
+// FileStore persists messages to an append-only JSON Lines file and
+// serves reads from an in-memory window of the newest messages. Shortly
+// after a message is deleted, the file is compacted to the window so the
+// deleted text does not stay on disk
+type FileStore struct {
+	mem     *MemoryStore
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	compact *time.Timer // Pending compaction after a deletion, nil when none
+}
+
+// NewFileStore opens (or creates) the history file at path and loads its contents
+func NewFileStore(path string, limit int) (*FileStore, error) {
+	s := &FileStore{mem: NewMemoryStore(limit), path: path}
+	deleted, err := s.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	s.file = file
+
+	// Deletions may not have been compacted before the server stopped
+	if deleted {
+		if err := s.rewrite(); err != nil {
+			log.Printf("[ERROR] Failed to compact %s: %v", path, err)
+		}
+	}
+	return s, nil
+}
+
+// load replays an existing history file into memory and reports whether
+// it records deleted messages
+func (s *FileStore) load(path string) (bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read history file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 2*maxMessageSize)
+	count := 0
+	deleted := false
+	for line := 1; scanner.Scan(); line++ {
+		var entry fileEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A partially written last line is expected after a crash
+			log.Printf("[WARN] Skipping invalid history entry at %s:%d: %v", path, line, err)
+			continue
+		}
+		switch entry.Op {
+		case "append":
+			if entry.Message != nil {
+				s.mem.put(*entry.Message)
+				count++
+			}
+		case "update":
+			if entry.Message != nil {
+				// The message may have left the in-memory window already
+				s.mem.Update(*entry.Message)
+				deleted = deleted || entry.Message.Deleted
+			}
+		case "delete_room":
+			s.mem.DeleteRoom(entry.Room)
+		case "rename_room":
+			s.mem.RenameRoom(entry.Room, entry.To)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read history file: %w", err)
+	}
+
+	log.Printf("[INFO] Loaded %d messages from %s", count, path)
+	return deleted, nil
+}
+
+// write appends an entry to the history file
+func (s *FileStore) write(entry fileEntry) error {
+	if s.file == nil {
+		return errStoreClosed
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileStore) Append(msg StoredMessage) (StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return msg, errStoreClosed
+	}
+	msg, _ = s.mem.Append(msg)
+	return msg, s.write(fileEntry{Op: "append", Message: &msg})
+}
+
+func (s *FileStore) Recent(room string, n int) ([]StoredMessage, error) {
+	return s.mem.Recent(room, n)
+}
+
+func (s *FileStore) Query(q MessageQuery) ([]StoredMessage, bool, error) {
+	return s.mem.Query(q)
+}
+
+func (s *FileStore) Get(room, id string) (StoredMessage, bool, error) {
+	return s.mem.Get(room, id)
+}
+
+func (s *FileStore) Update(msg StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.mem.Update(msg); err != nil {
+		return err
+	}
+	if err := s.write(fileEntry{Op: "update", Message: &msg}); err != nil {
+		return err
+	}
+	// The tombstone is recorded right away, the text is removed from the file
+	// by a compaction shared with the deletions that follow
+	if msg.Deleted && s.compact == nil {
+		s.compact = time.AfterFunc(compactDelay, s.compactPending)
+	}
+	return nil
+}
+
+// compactPending runs a scheduled compaction. A failed compaction only
+// leaves the deleted text on disk until the next deletion
+func (s *FileStore) compactPending() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.compact == nil || s.file == nil {
+		return
+	}
+	s.compact = nil
+	if err := s.rewrite(); err != nil {
+		log.Printf("[ERROR] Failed to remove deleted messages from %s: %v", s.path, err)
+	}
+}
+
+// rewrite replaces the history file with the messages of the in-memory
+// window, which drops every earlier version of a deleted message and keeps
+// the file as short as the window. Caller must hold the lock
+func (s *FileStore) rewrite() error {
+	var buf bytes.Buffer
+	for _, msg := range s.mem.snapshot() {
+		line, err := json.Marshal(fileEntry{Op: "append", Message: &msg})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if err := replaceFile(s.path, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	// Appends continue in the rewritten file
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	return nil
+}
+
+func (s *FileStore) DeleteRoom(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write(fileEntry{Op: "delete_room", Room: room}); err != nil {
+		return err
+	}
+	return s.mem.DeleteRoom(room)
+}
+
+func (s *FileStore) RenameRoom(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write(fileEntry{Op: "rename_room", Room: from, To: to}); err != nil {
+		return err
+	}
+	return s.mem.RenameRoom(from, to)
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	if s.compact != nil {
+		s.compact.Stop()
+		s.compact = nil
+		if err := s.rewrite(); err != nil {
+			log.Printf("[ERROR] Failed to remove deleted messages from %s: %v", s.path, err)
+		}
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// writeFileAtomic writes v as indented JSON to path, readable by the owner only
+func writeFileAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, data, 0o600)
+}
+
+// replaceFile replaces the contents of path through a temporary file, so a
+// crash never leaves a partial file
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	typingTimeout     = 10 * time.Second       // A state without a refresh expires after this time
+	typingMinInterval = 250 * time.Millisecond // Minimum time between broadcast state changes
+)
+
+// Typing states
+const (
+	typingStart    = "start"    // Typing a message
+	typingStop     = "stop"     // No longer typing, thinking or speaking
+	typingThinking = "thinking" // Generating a reply
+	typingSpeaking = "speaking" // Speaking with TTS
+)
+
+// validTypingState reports whether state is a known typing state
+func validTypingState(state string) bool {
+	switch state {
+	case typingStart, typingStop, typingThinking, typingSpeaking:
+		return true
+	}
+	return false
+}
+
+// TypingData represents the typing state of a user
+type TypingData struct {
+	User   string `json:"user"`
+	UserId string `json:"userId"`
+	State  string `json:"state"`
+}
+
+// typingIndicator tracks the typing state of a client and expires it when
+// it is not refreshed
+type typingIndicator struct {
+	mu      sync.Mutex
+	state   string // Current state, empty when stopped
+	changed time.Time
+	timer   *time.Timer
+	gen     int // Invalidates the expiry of earlier states
+}
+
+// set updates the state and reports whether the change should be broadcast.
+// Repeating the current state only refreshes its expiry, and changes arriving
+// faster than typingMinInterval are dropped. expire is called when the state
+// expires
+func (t *typingIndicator) set(state string, expire func()) bool {
+	if state == typingStop {
+		return t.stop()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state != t.state {
+		if time.Since(t.changed) < typingMinInterval {
+			return false
+		}
+		t.state = state
+		t.changed = time.Now()
+		t.schedule(expire)
+		return true
+	}
+	t.schedule(expire)
+	return false
+}
+
+// schedule restarts the expiry timer, caller must hold the lock
+func (t *typingIndicator) schedule(expire func()) {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.gen++
+	gen := t.gen
+	t.timer = time.AfterFunc(typingTimeout, func() {
+		t.mu.Lock()
+		active := t.gen == gen && t.state != ""
+		if active {
+			t.state = ""
+			t.timer = nil
+		}
+		t.mu.Unlock()
+
+		if active {
+			expire()
+		}
+	})
+}
+
+// stop clears the state and reports whether it was active
+func (t *typingIndicator) stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.gen++
+	active := t.state != ""
+	t.state = ""
+	return active
+}
+
+// setTyping applies a typing state sent by the client
+func (c *Client) setTyping(state string) {
+	if c.typing.set(state, func() { c.sendTyping(typingStop) }) {
+		c.sendTyping(state)
+	}
+}
+
+// sendTyping announces the typing state of the client to its room
+func (c *Client) sendTyping(state string) {
+	c.hub.broadcast <- WebSocketMessage{
+		Type:      "typing",
+		Room:      c.currentRoom(),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data: TypingData{
+			User:   c.name,
+			UserId: c.id,
+			State:  state,
+		},
+	}
+}
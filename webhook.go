@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	webhookQueueSize    = 1024             // Deliveries waiting for a worker
+	webhookWorkers      = 4                // Concurrent deliveries
+	webhookTimeout      = 10 * time.Second // Timeout of one delivery attempt
+	webhookMaxBackoff   = 5 * time.Minute  // Longest wait between attempts
+	maxDeadLetters      = 100              // Dead letters kept in memory for the API
+	maxWebhookURLLength = 2048
+	maxWebhookSecret    = 256
+)
+
+// Headers of webhook requests
+const (
+	webhookEventHeader     = "X-Bushitsu-Event"
+	webhookDeliveryHeader  = "X-Bushitsu-Delivery"
+	webhookTimestampHeader = "X-Bushitsu-Timestamp"
+	webhookSignatureHeader = "X-Bushitsu-Signature"
+)
+
+// webhookEvents lists the message types webhooks can subscribe to. Whispers,
+// direct messages and custom types are never posted
+var webhookEvents = map[string]bool{
+	"chat":       true,
+	"user_event": true,
+	"system":     true,
+}
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is an external endpoint that receives room events
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // Signing key, only returned on creation
+	Events    []string  `json:"events,omitempty"` // Empty receives every event type
+	Rooms     []string  `json:"rooms,omitempty"`  // Empty receives every room
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// wants reports whether the webhook subscribes to a message
+func (w *Webhook) wants(msg WebSocketMessage) bool {
+	if len(w.Events) > 0 && !slices.Contains(w.Events, msg.Type) {
+		return false
+	}
+	return len(w.Rooms) == 0 || slices.Contains(w.Rooms, msg.Room)
+}
+
+// WebhookStore keeps registered webhooks, optionally persisted to a JSON file
+type WebhookStore struct {
+	mu    sync.RWMutex
+	path  string
+	hooks map[string]*Webhook // Keyed by ID
+}
+
+// NewWebhookStore creates a webhook store, loading webhooks from path if it is set
+func NewWebhookStore(path string) (*WebhookStore, error) {
+	s := &WebhookStore{path: path, hooks: make(map[string]*Webhook)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook file: %w", err)
+	}
+
+	var hooks []*Webhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook file: %w", err)
+	}
+	for _, hook := range hooks {
+		s.hooks[hook.ID] = hook
+	}
+	log.Printf("[INFO] Loaded %d webhooks from %s", len(hooks), path)
+	return s, nil
+}
+
+// Add registers a webhook and returns it with its ID and secret
+func (s *WebhookStore) Add(hook Webhook) (Webhook, error) {
+	hook.ID = generateID("hook")
+	hook.CreatedAt = time.Now().UTC()
+	if hook.Secret == "" {
+		hook.Secret = generateID("whsec")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hooks[hook.ID] = &hook
+	if err := s.save(); err != nil {
+		delete(s.hooks, hook.ID)
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+// Remove deletes the webhook with the given ID
+func (s *WebhookStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook, ok := s.hooks[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", errWebhookNotFound, id)
+	}
+	delete(s.hooks, id)
+	if err := s.save(); err != nil {
+		s.hooks[id] = hook
+		return err
+	}
+	return nil
+}
+
+// Get returns the webhook with the given ID
+func (s *WebhookStore) Get(id string) (Webhook, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hook, ok := s.hooks[id]
+	if !ok {
+		return Webhook{}, false
+	}
+	return *hook, true
+}
+
+// List returns every webhook without its secret, oldest first
+func (s *WebhookStore) List() []Webhook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hooks := make([]Webhook, 0, len(s.hooks))
+	for _, hook := range s.hooks {
+		listed := *hook
+		listed.Secret = ""
+		hooks = append(hooks, listed)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+	})
+	return hooks
+}
+
+// matching returns the webhooks subscribed to a message
+func (s *WebhookStore) matching(msg WebSocketMessage) []Webhook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var hooks []Webhook
+	for _, hook := range s.hooks {
+		if hook.wants(msg) {
+			hooks = append(hooks, *hook)
+		}
+	}
+	return hooks
+}
+
+// save writes the webhooks to the webhook file, caller must hold the lock
+func (s *WebhookStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	hooks := make([]*Webhook, 0, len(s.hooks))
+	for _, hook := range s.hooks {
+		hooks = append(hooks, hook)
+	}
+	if err := writeFileAtomic(s.path, hooks); err != nil {
+		return fmt.Errorf("failed to write webhook file: %w", err)
+	}
+	return nil
+}
+
+// webhookDelivery is one message on its way to one webhook
+type webhookDelivery struct {
+	id       string
+	hookID   string
+	event    string
+	room     string
+	body     []byte
+	attempts int // Attempts made so far
+}
+
+// DeadLetter is a delivery that was given up on
+type DeadLetter struct {
+	DeliveryID string          `json:"deliveryId"`
+	WebhookID  string          `json:"webhookId"`
+	URL        string          `json:"url"`
+	Event      string          `json:"event"`
+	Room       string          `json:"room"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error"`
+	FailedAt   time.Time       `json:"failedAt"`
+	Payload    json.RawMessage `json:"payload"` // The message as it would have been posted
+}
+
+// WebhookDispatcher posts room events to webhooks from its own workers, so a
+// slow or failing endpoint never holds up the hub loop
+type WebhookDispatcher struct {
+	store          *WebhookStore
+	client         *http.Client
+	queue          chan *webhookDelivery
+	retries        int           // Attempts after the first one
+	backoff        time.Duration // Wait before the first retry, doubled for each further one
+	deadLetterPath string        // JSON Lines file of dead letters, empty keeps them in memory only
+
+	mu          sync.Mutex
+	deadLetters []DeadLetter // Most recent last
+}
+
+// NewWebhookDispatcher creates a dispatcher for the webhooks of store and
+// starts its workers
+func NewWebhookDispatcher(store *WebhookStore, retries int, backoff time.Duration, deadLetterPath string) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		store:          store,
+		client:         &http.Client{Timeout: webhookTimeout},
+		queue:          make(chan *webhookDelivery, webhookQueueSize),
+		retries:        retries,
+		backoff:        backoff,
+		deadLetterPath: deadLetterPath,
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// Dispatch queues a routed message, already encoded as data, for every
+// webhook subscribed to it. It never blocks; when the queue is full the
+// delivery goes straight to the dead letters
+func (d *WebhookDispatcher) Dispatch(msg WebSocketMessage, data []byte) {
+	if !webhookEvents[msg.Type] {
+		return
+	}
+	for _, hook := range d.store.matching(msg) {
+		delivery := &webhookDelivery{
+			id:     generateID("delivery"),
+			hookID: hook.ID,
+			event:  msg.Type,
+			room:   msg.Room,
+			body:   data,
+		}
+		select {
+		case d.queue <- delivery:
+		default:
+			d.deadLetter(delivery, hook.URL, errors.New("delivery queue is full"))
+		}
+	}
+}
+
+// work delivers queued messages until the process exits
+func (d *WebhookDispatcher) work() {
+	for delivery := range d.queue {
+		d.attempt(delivery)
+	}
+}
+
+// attempt makes one delivery attempt and schedules a retry if it failed
+func (d *WebhookDispatcher) attempt(delivery *webhookDelivery) {
+	// Deliveries to webhooks removed in the meantime are dropped
+	hook, ok := d.store.Get(delivery.hookID)
+	if !ok {
+		return
+	}
+
+	delivery.attempts++
+	retry, err := d.post(hook, delivery)
+	if err == nil {
+		return
+	}
+	if !retry || delivery.attempts > d.retries {
+		d.deadLetter(delivery, hook.URL, err)
+		return
+	}
+
+	wait := d.backoff << (delivery.attempts - 1)
+	if wait <= 0 || wait > webhookMaxBackoff {
+		wait = webhookMaxBackoff
+	}
+	log.Printf("[WARN] Webhook delivery %s to %s failed (attempt %d): %v, retrying in %s", delivery.id, hook.URL, delivery.attempts, err, wait)
+	time.AfterFunc(wait, func() {
+		select {
+		case d.queue <- delivery:
+		default:
+			d.deadLetter(delivery, hook.URL, fmt.Errorf("delivery queue is full after: %w", err))
+		}
+	})
+}
+
+// post sends a delivery to a webhook and reports whether a failure is worth
+// retrying. Network errors, timeouts, 408, 429 and 5xx responses are retried
+func (d *WebhookDispatcher) post(hook Webhook, delivery *webhookDelivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "aituber-onair-bushitsu-webhook")
+	req.Header.Set(webhookEventHeader, delivery.event)
+	req.Header.Set(webhookDeliveryHeader, delivery.id)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(hook.Secret, timestamp, delivery.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s", resp.Status)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of "timestamp.body"
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter records a delivery that was given up on
+func (d *WebhookDispatcher) deadLetter(delivery *webhookDelivery, hookURL string, err error) {
+	letter := DeadLetter{
+		DeliveryID: delivery.id,
+		WebhookID:  delivery.hookID,
+		URL:        hookURL,
+		Event:      delivery.event,
+		Room:       delivery.room,
+		Attempts:   delivery.attempts,
+		Error:      err.Error(),
+		FailedAt:   time.Now().UTC(),
+		Payload:    delivery.body,
+	}
+	log.Printf("[ERROR] Webhook delivery %s to %s given up after %d attempts: %v", delivery.id, hookURL, delivery.attempts, err)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deadLetters = append(d.deadLetters, letter)
+	if len(d.deadLetters) > maxDeadLetters {
+		d.deadLetters = slices.Delete(d.deadLetters, 0, len(d.deadLetters)-maxDeadLetters)
+	}
+	if d.deadLetterPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal dead letter: %v", err)
+		return
+	}
+	file, err := os.OpenFile(d.deadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("[ERROR] Failed to open dead letter file: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("[ERROR] Failed to write dead letter: %v", err)
+	}
+}
+
+// DeadLetters returns the most recent dead letters, oldest first
+func (d *WebhookDispatcher) DeadLetters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.deadLetters)
+}
+
+// Webhook API types
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"` // Generated when empty
+	Events []string `json:"events,omitempty"` // "chat", "user_event" and "system", empty for all
+	Rooms  []string `json:"rooms,omitempty"`  // Empty for all rooms
+}
+
+type WebhooksResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"deadLetters"`
+}
+
+// validate checks the fields of a webhook registration
+func (req CreateWebhookRequest) validate() error {
+	if req.URL == "" {
+		return errors.New("url is required")
+	}
+	if len(req.URL) > maxWebhookURLLength {
+		return fmt.Errorf("url must be at most %d bytes", maxWebhookURLLength)
+	}
+	parsed, err := url.Parse(req.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(req.Secret) > maxWebhookSecret {
+		return fmt.Errorf("secret must be at most %d bytes", maxWebhookSecret)
+	}
+	for _, event := range req.Events {
+		if !webhookEvents[event] {
+			return fmt.Errorf("unknown event: %q (must be chat, user_event or system)", event)
+		}
+	}
+	for _, room := range req.Rooms {
+		if room == "" {
+			return errors.New("room names must not be empty")
+		}
+	}
+	return nil
+}
+
+// handleCreateWebhook handles POST /api/webhooks
+func handleCreateWebhook(webhooks *WebhookStore, w http.ResponseWriter, r *http.Request) {
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hook, err := webhooks.Add(Webhook{URL: req.URL, Secret: req.Secret, Events: req.Events, Rooms: req.Rooms})
+	if err != nil {
+		log.Printf("[ERROR] Failed to register webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to register webhook")
+		return
+	}
+
+	log.Printf("[INFO] Webhook registered: id=%s, url=%s, events=%v, rooms=%v", hook.ID, hook.URL, hook.Events, hook.Rooms)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// handleGetWebhooks handles GET /api/webhooks
+func handleGetWebhooks(webhooks *WebhookStore, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, WebhooksResponse{Webhooks: webhooks.List()})
+}
+
+// handleDeleteWebhook handles DELETE /api/webhooks/{id}
+func handleDeleteWebhook(webhooks *WebhookStore, w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := webhooks.Remove(id); err != nil {
+		if errors.Is(err, errWebhookNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("[ERROR] Failed to remove webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to remove webhook")
+		return
+	}
+
+	log.Printf("[INFO] Webhook removed: id=%s", id)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "id": id})
+}
+
+// handleGetDeadLetters handles GET /api/webhooks/dead-letters
+func handleGetDeadLetters(dispatcher *WebhookDispatcher, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, DeadLettersResponse{DeadLetters: dispatcher.DeadLetters()})
+}